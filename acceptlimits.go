@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Ограничения приёма соединений - причины отказа в журнале и статистике
+const (
+	limitMaxConnections       = "maxConnections"
+	limitMaxConnectionsPerIP  = "maxConnectionsPerIP"
+	limitMaxPendingHandshakes = "maxPendingHandshakes"
+)
+
+// Поведение при достижении maxConnections или maxPendingHandshakes (limits.onLimit)
+const (
+	acceptReject = "reject"
+	acceptQueue  = "queue"
+)
+
+// acceptLogInterval - отказы по одной причине пишутся в журнал не чаще этого интервала,
+// чтобы поток соединений не переполнил журнал
+const acceptLogInterval = 10 * time.Second
+
+// LimitsConfig задаёт ограничения приёма соединений (секция limits); 0 - без ограничения
+type LimitsConfig struct {
+	MaxConnections       int           `yaml:"maxConnections"`       // Одновременных соединений на весь сервер
+	MaxConnectionsPerIP  int           `yaml:"maxConnectionsPerIP"`  // Одновременных соединений с одного адреса
+	MaxPendingHandshakes int           `yaml:"maxPendingHandshakes"` // Соединений, клиенты которых ещё не прислали запрос
+	OnLimit              string        `yaml:"onLimit"`              // reject - закрыть новое соединение, queue - приостановить приём
+	QueueTimeout         time.Duration `yaml:"queueTimeout"`         // Сколько ждать свободного места при onLimit: queue
+}
+
+// validate проверяет ограничения приёма соединений
+func (c LimitsConfig) validate() error {
+	if c.MaxConnections < 0 || c.MaxConnectionsPerIP < 0 || c.MaxPendingHandshakes < 0 {
+		return fmt.Errorf("ограничения не могут быть отрицательными")
+	}
+	if c.OnLimit != acceptReject && c.OnLimit != acceptQueue {
+		return fmt.Errorf("onLimit: ожидается %s или %s, получено %q", acceptReject, acceptQueue, c.OnLimit)
+	}
+	if c.OnLimit == acceptQueue && c.QueueTimeout <= 0 {
+		return fmt.Errorf("queueTimeout должен быть больше нуля")
+	}
+	return nil
+}
+
+// AcceptLimitStats - состояние ограничений приёма соединений для статистики
+type AcceptLimitStats struct {
+	PendingHandshakes int64            `json:"pendingHandshakes"` // Соединений, клиенты которых ещё не прислали запрос
+	Rejected          map[string]int64 `json:"rejected"`          // Отклонено соединений по причинам с момента запуска
+	Queued            int64            `json:"queued"`            // Соединений, ожидавших свободного места, с момента запуска
+}
+
+// acceptLogState - подавление повторяющихся записей об отказах одной причины
+type acceptLogState struct {
+	last       time.Time
+	suppressed int64
+}
+
+var (
+	connSlots      chan struct{} // Занятые места maxConnections; nil - без ограничения
+	handshakeSlots chan struct{} // Занятые места maxPendingHandshakes; nil - без ограничения
+
+	pendingHandshakes atomic.Int64
+
+	connsPerIP     = make(map[string]int) // Открытые соединения по адресам клиентов
+	acceptRejected = make(map[string]int64)
+	acceptQueued   int64
+	acceptLogged   = make(map[string]*acceptLogState)
+	acceptMutex    sync.Mutex // Мьютекс для доступа к connsPerIP, acceptRejected, acceptQueued и acceptLogged
+)
+
+// initAcceptLimits создаёт счётчики мест по настройкам limits. Вызывается до запуска слушателей.
+func initAcceptLimits() {
+	if n := config.Limits.MaxConnections; n > 0 {
+		connSlots = make(chan struct{}, n)
+	}
+	if n := config.Limits.MaxPendingHandshakes; n > 0 {
+		handshakeSlots = make(chan struct{}, n)
+	}
+}
+
+// connAdmission - места, занятые принятым соединением
+type connAdmission struct {
+	ip        string      // Адрес, учтённый в connsPerIP; пусто, если ограничения на адрес нет
+	slot      bool        // Занято место maxConnections
+	handshake atomic.Bool // Рукопожатие ещё не завершено
+}
+
+// admitConn проверяет ограничения приёма для только что принятого соединения.
+// Соединение сверх maxConnectionsPerIP закрывается сразу. При нехватке мест maxConnections
+// или maxPendingHandshakes соединение закрывается, а при onLimit: queue ждёт освобождения
+// места не дольше queueTimeout; пока оно ждёт, слушатель не принимает новых соединений,
+// и они остаются в очереди ядра.
+func admitConn(conn net.Conn) (*connAdmission, bool) {
+	adm := &connAdmission{}
+	if perIP := config.Limits.MaxConnectionsPerIP; perIP > 0 {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip := addr.IP.String()
+			acceptMutex.Lock()
+			over := connsPerIP[ip] >= perIP
+			if !over {
+				connsPerIP[ip]++
+			}
+			acceptMutex.Unlock()
+			if over {
+				rejectConn(conn, limitMaxConnectionsPerIP, perIP)
+				return nil, false
+			}
+			adm.ip = ip
+		}
+	}
+
+	if !acquireSlot(connSlots) {
+		adm.release()
+		rejectConn(conn, limitMaxConnections, config.Limits.MaxConnections)
+		return nil, false
+	}
+	adm.slot = connSlots != nil
+
+	if !acquireSlot(handshakeSlots) {
+		adm.release()
+		rejectConn(conn, limitMaxPendingHandshakes, config.Limits.MaxPendingHandshakes)
+		return nil, false
+	}
+	adm.handshake.Store(true)
+	pendingHandshakes.Add(1)
+	return adm, true
+}
+
+// acquireSlot занимает место в slots. Если мест нет, при onLimit: queue ждёт
+// не дольше queueTimeout, иначе сразу возвращает false.
+func acquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if config.Limits.OnLimit != acceptQueue {
+		return false
+	}
+
+	acceptMutex.Lock()
+	acceptQueued++
+	acceptMutex.Unlock()
+
+	timer := time.NewTimer(config.Limits.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// rejectConn закрывает соединение сверх ограничения limit, учитывает отказ и пишет его в журнал
+func rejectConn(conn net.Conn, limit string, value int) {
+	conn.Close()
+
+	acceptMutex.Lock()
+	defer acceptMutex.Unlock()
+
+	acceptRejected[limit]++
+	state, ok := acceptLogged[limit]
+	if !ok {
+		state = &acceptLogState{}
+		acceptLogged[limit] = state
+	}
+	now := time.Now()
+	if now.Sub(state.last) < acceptLogInterval {
+		state.suppressed++
+		return
+	}
+	suffix := ""
+	if state.suppressed > 0 {
+		suffix = fmt.Sprintf(" (и ещё %d по этой причине с %s)", state.suppressed, state.last.Format("15:04:05"))
+	}
+	log.Printf("Отклонено соединение от %s: достигнуто ограничение %s (%d)%s", conn.RemoteAddr(), limit, value, suffix)
+	state.last, state.suppressed = now, 0
+}
+
+// handshakeDone освобождает место maxPendingHandshakes; повторные вызовы ничего не делают
+func (a *connAdmission) handshakeDone() {
+	if !a.handshake.CompareAndSwap(true, false) {
+		return
+	}
+	pendingHandshakes.Add(-1)
+	if handshakeSlots != nil {
+		<-handshakeSlots
+	}
+}
+
+// release освобождает все места, занятые соединением. Вызывается при его закрытии.
+func (a *connAdmission) release() {
+	a.handshakeDone()
+	if a.slot {
+		<-connSlots
+		a.slot = false
+	}
+	if a.ip != "" {
+		acceptMutex.Lock()
+		connsPerIP[a.ip]--
+		if connsPerIP[a.ip] <= 0 {
+			delete(connsPerIP, a.ip)
+		}
+		acceptMutex.Unlock()
+		a.ip = ""
+	}
+}
+
+// acceptLimitStats возвращает состояние ограничений приёма соединений
+func acceptLimitStats() *AcceptLimitStats {
+	acceptMutex.Lock()
+	defer acceptMutex.Unlock()
+
+	stats := &AcceptLimitStats{
+		PendingHandshakes: pendingHandshakes.Load(),
+		Rejected:          make(map[string]int64, len(acceptRejected)),
+		Queued:            acceptQueued,
+	}
+	for limit, n := range acceptRejected {
+		stats.Rejected[limit] = n
+	}
+	return stats
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accountCheckInterval - как часто проверяются сроки действия и расписания учётных записей
+const accountCheckInterval = 10 * time.Second
+
+// Состояния учётной записи в статистике
+const (
+	accountActive      = "active"
+	accountPending     = "pending"      // validFrom ещё не наступил
+	accountExpired     = "expired"      // expiresAt прошёл
+	accountOffSchedule = "off-schedule" // Текущее время вне расписания
+	accountDisabled    = "disabled"
+)
+
+var (
+	errInvalidCredentials = errors.New("неверные имя пользователя или пароль, или пользователь неактивен")
+	errAccountPending     = errors.New("учётная запись ещё не действует")
+	errAccountExpired     = errors.New("срок действия учётной записи истёк")
+	errOffSchedule        = errors.New("вход вне разрешённого расписания")
+)
+
+// weekdays - дни недели в расписании
+var weekdays = map[string]time.Weekday{
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+	"sun": time.Sunday,
+}
+
+// Schedule задаёт часы, в которые пользователю разрешена работа (поле schedule в users.json)
+type Schedule struct {
+	Timezone string           `json:"timezone,omitempty"` // Часовой пояс IANA, например Europe/Moscow; по умолчанию местный
+	Windows  []ScheduleWindow `json:"windows"`
+}
+
+// ScheduleWindow - разрешённый интервал времени. Если to не позже from, интервал
+// переходит через полночь и относится к дню своего начала.
+type ScheduleWindow struct {
+	Days []string `json:"days,omitempty"` // mon..sun; пусто - каждый день
+	From string   `json:"from"`           // Начало, ЧЧ:ММ
+	To   string   `json:"to"`             // Конец, ЧЧ:ММ (24:00 - до конца суток)
+}
+
+// AccountStatus - состояние учётной записи с ограниченным сроком действия или расписанием
+type AccountStatus struct {
+	Status    string    `json:"status"` // active, pending, expired, off-schedule или disabled
+	ValidFrom time.Time `json:"validFrom,omitzero"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+var (
+	locations      = make(map[string]*time.Location) // Загруженные часовые пояса расписаний
+	locationsMutex sync.Mutex                        // Мьютекс для доступа к locations
+)
+
+// loadLocation загружает часовой пояс расписания; пустое имя - местное время сервера
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	locationsMutex.Lock()
+	defer locationsMutex.Unlock()
+
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// parseClock разбирает время суток ЧЧ:ММ и возвращает число минут от полуночи
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok || len(h) != 2 || len(m) != 2 {
+		return 0, fmt.Errorf("время %q должно быть в формате ЧЧ:ММ", s)
+	}
+	hours, err1 := strconv.Atoi(h)
+	minutes, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("некорректное время %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// validate проверяет расписание
+func (s *Schedule) validate() error {
+	if _, err := loadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("часовой пояс %q: %w", s.Timezone, err)
+	}
+	if len(s.Windows) == 0 {
+		return fmt.Errorf("не задано ни одного интервала windows")
+	}
+	for i, w := range s.Windows {
+		from, err := parseClock(w.From)
+		if err != nil {
+			return fmt.Errorf("windows[%d].from: %w", i, err)
+		}
+		to, err := parseClock(w.To)
+		if err != nil {
+			return fmt.Errorf("windows[%d].to: %w", i, err)
+		}
+		if from == to || from == 24*60 {
+			return fmt.Errorf("windows[%d]: пустой интервал %s-%s", i, w.From, w.To)
+		}
+		for _, day := range w.Days {
+			if _, ok := weekdays[day]; !ok {
+				return fmt.Errorf("windows[%d]: неизвестный день %q (ожидается mon, tue, wed, thu, fri, sat или sun)", i, day)
+			}
+		}
+	}
+	return nil
+}
+
+// allows сообщает, попадает ли момент now в один из интервалов расписания
+func (s *Schedule) allows(now time.Time) bool {
+	loc, err := loadLocation(s.Timezone)
+	if err != nil {
+		return false
+	}
+	t := now.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+	today, yesterday := t.Weekday(), (t.Weekday()+6)%7
+
+	for _, w := range s.Windows {
+		from, err1 := parseClock(w.From)
+		to, err2 := parseClock(w.To)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if from < to {
+			if w.onDay(today) && minute >= from && minute < to {
+				return true
+			}
+			continue
+		}
+		// Интервал через полночь: вечер дня начала или утро следующего дня
+		if (w.onDay(today) && minute >= from) || (w.onDay(yesterday) && minute < to) {
+			return true
+		}
+	}
+	return false
+}
+
+// onDay сообщает, действует ли интервал в указанный день недели
+func (w ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if weekdays[name] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// restricted сообщает, ограничена ли учётная запись по сроку или расписанию
+func (u User) restricted() bool {
+	return !u.ValidFrom.IsZero() || !u.ExpiresAt.IsZero() || u.Schedule != nil
+}
+
+// accessError проверяет срок действия и расписание учётной записи на момент now
+func (u User) accessError(now time.Time) error {
+	switch {
+	case !u.ValidFrom.IsZero() && now.Before(u.ValidFrom):
+		return errAccountPending
+	case !u.ExpiresAt.IsZero() && !now.Before(u.ExpiresAt):
+		return errAccountExpired
+	case u.Schedule != nil && !u.Schedule.allows(now):
+		return errOffSchedule
+	}
+	return nil
+}
+
+// validateAccountWindow проверяет поля validFrom, expiresAt и schedule пользователя
+func validateAccountWindow(u User) error {
+	if !u.ValidFrom.IsZero() && !u.ExpiresAt.IsZero() && !u.ExpiresAt.After(u.ValidFrom) {
+		return fmt.Errorf("expiresAt должен быть позже validFrom")
+	}
+	if u.Schedule != nil {
+		if err := u.Schedule.validate(); err != nil {
+			return fmt.Errorf("schedule: %w", err)
+		}
+	}
+	return nil
+}
+
+// accountStats возвращает состояние учётных записей с ограниченным сроком или расписанием
+func accountStats() map[string]*AccountStatus {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]*AccountStatus)
+	for username, user := range users {
+		if !user.restricted() {
+			continue
+		}
+		status := &AccountStatus{Status: accountActive, ValidFrom: user.ValidFrom, ExpiresAt: user.ExpiresAt}
+		switch err := user.accessError(now); {
+		case !user.Enabled:
+			status.Status = accountDisabled
+		case errors.Is(err, errAccountPending):
+			status.Status = accountPending
+		case errors.Is(err, errAccountExpired):
+			status.Status = accountExpired
+		case errors.Is(err, errOffSchedule):
+			status.Status = accountOffSchedule
+		}
+		result[username] = status
+	}
+	return result
+}
+
+// watchAccountWindows закрывает сессии пользователей, у которых истёк срок действия
+// или закончился разрешённый по расписанию интервал (users.terminateExpired)
+func watchAccountWindows() {
+	ticker := time.NewTicker(accountCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		ended := make(map[string]bool)
+		usersMutex.RLock()
+		for username, user := range users {
+			if user.accessError(now) != nil {
+				ended[username] = true
+			}
+		}
+		usersMutex.RUnlock()
+
+		if len(ended) == 0 {
+			continue
+		}
+		if n := closeUserSessions(ended); n > 0 {
+			log.Printf("Закрыто сессий пользователей с истёкшим сроком действия или вне расписания: %d", n)
+		}
+	}
+}
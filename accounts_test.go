@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		in      string
+		minutes int
+		ok      bool
+	}{
+		{"00:00", 0, true},
+		{"09:30", 570, true},
+		{"23:59", 1439, true},
+		{"24:00", 1440, true},
+		{"24:01", 0, false},
+		{"12:60", 0, false},
+		{"9:30", 0, false},
+		{"09-30", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		minutes, err := parseClock(tt.in)
+		if (err == nil) != tt.ok || minutes != tt.minutes {
+			t.Errorf("parseClock(%q) = %d, %v, ожидалось %d (корректно: %v)", tt.in, minutes, err, tt.minutes, tt.ok)
+		}
+	}
+}
+
+func TestScheduleAllows(t *testing.T) {
+	s := &Schedule{
+		Timezone: "UTC",
+		Windows: []ScheduleWindow{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "18:00"},
+			{Days: []string{"fri"}, From: "22:00", To: "02:00"},
+			{Days: []string{"sun"}, From: "12:00", To: "24:00"},
+		},
+	}
+	if err := s.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	// 2026-10-16 - пятница
+	at := func(d, h, m int) time.Time { return time.Date(2026, 10, d, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"начало рабочего дня", at(16, 9, 0), true},
+		{"конец рабочего дня не входит", at(16, 18, 0), false},
+		{"до начала", at(16, 8, 59), false},
+		{"вечер пятницы", at(16, 23, 30), true},
+		{"ночь на субботу", at(17, 1, 59), true},
+		{"утро субботы после окна", at(17, 2, 0), false},
+		{"ночь на пятницу", at(16, 1, 0), false},
+		{"воскресенье до конца суток", at(18, 23, 59), true},
+		{"воскресенье утром", at(18, 11, 0), false},
+		{"время в другом поясе, в UTC вне окна", time.Date(2026, 10, 16, 11, 30, 0, 0, time.FixedZone("MSK", 3*3600)), false},
+		{"время в другом поясе, в UTC в окне", time.Date(2026, 10, 16, 20, 30, 0, 0, time.FixedZone("MSK", 3*3600)), true},
+	}
+	for _, tt := range tests {
+		if got := s.allows(tt.now); got != tt.want {
+			t.Errorf("%s: allows(%s) = %v, ожидалось %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestUserAccessError(t *testing.T) {
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	u := User{ValidFrom: from, ExpiresAt: until}
+
+	tests := []struct {
+		now  time.Time
+		want error
+	}{
+		{from.Add(-time.Second), errAccountPending},
+		{from, nil},
+		{until.Add(-time.Second), nil},
+		{until, errAccountExpired},
+	}
+	for _, tt := range tests {
+		if err := u.accessError(tt.now); !errors.Is(err, tt.want) {
+			t.Errorf("accessError(%s) = %v, ожидалось %v", tt.now, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Действия правил доступа к адресам назначения
+const (
+	aclAllow = "allow"
+	aclDeny  = "deny"
+)
+
+// errDestinationDenied возвращается, когда соединение с адресом назначения запрещено правилами
+var errDestinationDenied = errors.New("соединение запрещено правилами доступа")
+
+// ACLConfig - общие правила доступа к адресам назначения (секция acl)
+type ACLConfig struct {
+	Default string    `yaml:"default"` // Действие, если ни одно правило не подошло: allow или deny
+	Rules   []ACLRule `yaml:"rules"`
+}
+
+// ACLRule - правило доступа. Правило подходит, если адрес назначения попадает в одну
+// из сетей networks, под один из шаблонов domains или под regex (если ничего из этого
+// не задано - любой адрес) и порт попадает в ports (если задан).
+type ACLRule struct {
+	Action   string   `json:"action" yaml:"action"`                         // allow или deny
+	Networks []string `json:"networks,omitempty" yaml:"networks,omitempty"` // Сети CIDR или отдельные IP
+	Domains  []string `json:"domains,omitempty" yaml:"domains,omitempty"`   // example.com - домен с поддоменами, *.example.com - шаблон
+	Regex    string   `json:"regex,omitempty" yaml:"regex,omitempty"`       // Регулярное выражение для имени хоста
+	Ports    []string `json:"ports,omitempty" yaml:"ports,omitempty"`       // Порты и диапазоны: "25", "8000-8080"
+
+	networks []*net.IPNet
+	regex    *regexp.Regexp
+	ports    [][2]int
+}
+
+// compile проверяет правило и разбирает сети, регулярное выражение и порты
+func (r *ACLRule) compile() error {
+	if r.Action != aclAllow && r.Action != aclDeny {
+		return fmt.Errorf("action: ожидается %s или %s, получено %q", aclAllow, aclDeny, r.Action)
+	}
+	r.networks = nil
+	for _, s := range r.Networks {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return err
+		}
+		r.networks = append(r.networks, ipNet)
+	}
+	for _, d := range r.Domains {
+		if d == "" {
+			return fmt.Errorf("пустой шаблон в domains")
+		}
+		if _, err := path.Match(d, ""); err != nil {
+			return fmt.Errorf("некорректный шаблон домена %q: %w", d, err)
+		}
+	}
+	r.regex = nil
+	if r.Regex != "" {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return fmt.Errorf("некорректное регулярное выражение %q: %w", r.Regex, err)
+		}
+		r.regex = re
+	}
+	r.ports = nil
+	for _, p := range r.Ports {
+		portRange, err := parsePortRange(p)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, portRange)
+	}
+	return nil
+}
+
+// parseNetwork разбирает сеть CIDR; отдельный IP считается сетью из одного адреса
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("некорректный адрес %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("некорректная сеть %q: %w", s, err)
+	}
+	return ipNet, nil
+}
+
+// parsePortRange разбирает порт или диапазон портов "начало-конец"
+func parsePortRange(s string) ([2]int, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(first))
+	end, err2 := strconv.Atoi(strings.TrimSpace(last))
+	if err1 != nil || err2 != nil || start < 1 || end > 65535 || start > end {
+		return [2]int{}, fmt.Errorf("некорректный порт или диапазон портов %q", s)
+	}
+	return [2]int{start, end}, nil
+}
+
+// compileACL проверяет и разбирает список правил
+func compileACL(rules []ACLRule) error {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("правило %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// matches проверяет, подходит ли правило для адреса назначения. host - имя хоста
+// из запроса (пусто, если клиент указал IP), ip - адрес, с которым будет соединение
+// (nil, пока имя не разрешено).
+func (r *ACLRule) matches(host string, ip net.IP, port int) bool {
+	if !r.matchesPort(port) {
+		return false
+	}
+
+	if len(r.networks) == 0 && len(r.Domains) == 0 && r.regex == nil {
+		return true
+	}
+	for _, ipNet := range r.networks {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if host == "" {
+		// Регулярное выражение для IP-адреса проверяется по его записи
+		return r.regex != nil && r.regex.MatchString(ip.String())
+	}
+	for _, d := range r.Domains {
+		if domainMatches(d, host) {
+			return true
+		}
+	}
+	return r.regex != nil && r.regex.MatchString(host)
+}
+
+// matchesPort проверяет порт по списку ports правила
+func (r *ACLRule) matchesPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if port >= p[0] && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// needsAddress сообщает, что до разрешения имени нельзя решить, подходит ли правило
+func (r *ACLRule) needsAddress(host string, port int) bool {
+	return len(r.networks) > 0 && r.matchesPort(port) && !r.matches(host, nil, port)
+}
+
+// domainMatches сравнивает имя хоста с шаблоном: шаблон со звёздочкой сравнивается
+// целиком, обычное имя совпадает с самим доменом и всеми его поддоменами
+func domainMatches(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// String описывает правило для журнала
+func (r *ACLRule) String() string {
+	parts := []string{r.Action}
+	if len(r.Networks) > 0 {
+		parts = append(parts, "networks="+strings.Join(r.Networks, ","))
+	}
+	if len(r.Domains) > 0 {
+		parts = append(parts, "domains="+strings.Join(r.Domains, ","))
+	}
+	if r.Regex != "" {
+		parts = append(parts, "regex="+r.Regex)
+	}
+	if len(r.Ports) > 0 {
+		parts = append(parts, "ports="+strings.Join(r.Ports, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// aclVerdict - решение правил доступа для одного адреса
+type aclVerdict struct {
+	allowed bool
+	rule    string // Какое правило сработало, для журнала
+}
+
+// evaluateACL проверяет адрес сначала по правилам пользователя, затем по правилам точки
+// входа l (если она известна), затем по общим правилам. Срабатывает первое подходящее
+// правило; если не подошло ни одно - действие acl.default. При ip == nil возвращает false,
+// если решение зависит от адреса, в который разрешится имя.
+func evaluateACL(userRules []ACLRule, l *proxyListener, host string, ip net.IP, port int) (aclVerdict, bool) {
+	var listenerRules []ACLRule
+	if l != nil {
+		listenerRules = l.acl
+	}
+	lists := []struct {
+		rules []ACLRule
+		name  string
+	}{
+		{userRules, "правило пользователя"},
+		{listenerRules, "правило точки входа"},
+		{config.ACL.Rules, "общее правило"},
+	}
+	for _, list := range lists {
+		for i := range list.rules {
+			r := &list.rules[i]
+			if r.matches(host, ip, port) {
+				return aclVerdict{r.Action == aclAllow, fmt.Sprintf("%s %d (%s)", list.name, i+1, r)}, true
+			}
+			if ip == nil && r.needsAddress(host, port) {
+				return aclVerdict{}, false
+			}
+		}
+	}
+	return aclVerdict{config.ACL.Default != aclDeny, "правило по умолчанию (" + config.ACL.Default + ")"}, true
+}
+
+// userACL возвращает правила доступа пользователя из users.json
+func userACL(username string) []ACLRule {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	return users[username].ACL
+}
+
+// resolveDestination разрешает адрес назначения и возвращает адреса, соединение с которыми
+// разрешено правилами доступа и защитой внутренних сетей. Если решение зависит от сетей,
+// имя хоста проверяется вместе с каждым из его адресов, поэтому имя, указывающее на
+// запрещённую сеть, тоже отклоняется. Отказ записывается в журнал.
+func resolveDestination(ctx context.Context, sess *session, host string, port int) ([]net.IP, error) {
+	rules := userACL(sess.username)
+	var ips []net.IP
+	var decided aclVerdict
+	name := ""
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		name = strings.ToLower(strings.TrimSuffix(host, "."))
+		verdict, ok := evaluateACL(rules, sess.listener, name, nil, port)
+		if ok && !verdict.allowed {
+			return nil, denyDestination(sess, host, port, verdict)
+		}
+		if ok {
+			decided = verdict
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+
+	// Если имя разрешено правилом, не зависящим от адреса, адреса по правилам не проверяются
+	allowed := ips
+	if !decided.allowed {
+		allowed = nil
+		var denied aclVerdict
+		for _, ip := range ips {
+			verdict, _ := evaluateACL(rules, sess.listener, name, ip, port)
+			if verdict.allowed {
+				allowed = append(allowed, ip)
+			} else if denied.rule == "" {
+				denied = verdict
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, denyDestination(sess, host, port, denied)
+		}
+	}
+	return filterProtected(sess, host, port, allowed)
+}
+
+// denyDestination записывает отказ в журнал и возвращает errDestinationDenied
+func denyDestination(sess *session, host string, port int, verdict aclVerdict) error {
+	log.Printf("ACL: отказано в соединении пользователя %s (с %s) с %s: %s",
+		sess.username, sess.clientIP, net.JoinHostPort(host, strconv.Itoa(port)), verdict.rule)
+	return errDestinationDenied
+}
+
+// dialDestination устанавливает TCP-соединение с адресом назначения, если его разрешают
+// правила доступа. Адреса имени перебираются по порядку до первого успешного соединения;
+// разрешение имени и все попытки вместе ограничены timeouts.connect.
+func dialDestination(sess *session, host string, port int) (net.Conn, error) {
+	ctx, cancel := connectContext()
+	defer cancel()
+
+	ips, err := resolveDestination(ctx, sess, host, port)
+	if err != nil {
+		return nil, connectTimeout(err)
+	}
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, connectTimeout(lastErr)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEvaluateACL(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultConfig()
+	config.ACL = ACLConfig{
+		Default: aclAllow,
+		Rules: []ACLRule{
+			{Action: aclDeny, Ports: []string{"25", "465-587"}},
+			{Action: aclDeny, Networks: []string{"203.0.113.0/24"}},
+		},
+	}
+	userRules := []ACLRule{
+		{Action: aclAllow, Domains: []string{"mail.example.com"}},
+		{Action: aclDeny, Domains: []string{"example.com"}},
+	}
+	listener := &proxyListener{name: "office", acl: []ACLRule{
+		{Action: aclDeny, Regex: `^ads\.`},
+		{Action: aclAllow, Networks: []string{"203.0.113.10"}},
+	}}
+	for _, rules := range [][]ACLRule{config.ACL.Rules, userRules, listener.acl} {
+		if err := compileACL(rules); err != nil {
+			t.Fatalf("compileACL: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		listener *proxyListener
+		host     string
+		ip       string
+		port     int
+		decided  bool
+		allowed  bool
+		rule     string
+	}{
+		{"правило пользователя раньше общего", listener, "mail.example.com", "", 25, true, true, "правило пользователя 1"},
+		{"поддомен", listener, "www.example.com", "", 443, true, false, "правило пользователя 2"},
+		{"правило точки входа", listener, "ads.example.org", "", 443, true, false, "правило точки входа 1"},
+		{"точка входа раньше общего", listener, "", "203.0.113.10", 443, true, true, "правило точки входа 2"},
+		{"без точки входа", nil, "", "203.0.113.10", 443, true, false, "общее правило 2"},
+		{"общее правило по порту", nil, "smtp.example.org", "", 587, true, false, "общее правило 1"},
+		{"правило по умолчанию", listener, "example.org", "198.51.100.1", 443, true, true, "правило по умолчанию (allow)"},
+		{"имя не разрешено", nil, "host.example.org", "", 443, false, false, ""},
+		{"имя разрешено", nil, "host.example.org", "203.0.113.5", 443, true, false, "общее правило 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict, decided := evaluateACL(userRules, tt.listener, tt.host, net.ParseIP(tt.ip), tt.port)
+			if decided != tt.decided {
+				t.Fatalf("decided = %v, ожидалось %v", decided, tt.decided)
+			}
+			if !decided {
+				return
+			}
+			if verdict.allowed != tt.allowed {
+				t.Errorf("allowed = %v, ожидалось %v (%s)", verdict.allowed, tt.allowed, verdict.rule)
+			}
+			if !strings.HasPrefix(verdict.rule, tt.rule) {
+				t.Errorf("rule = %q, ожидалось %q", verdict.rule, tt.rule)
+			}
+		})
+	}
+}
+
+func TestEvaluateACLDefaultDeny(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultConfig()
+	config.ACL = ACLConfig{Default: aclDeny}
+	verdict, decided := evaluateACL(nil, nil, "example.org", nil, 80)
+	if !decided || verdict.allowed {
+		t.Errorf("evaluateACL = %+v, %v, ожидался отказ по умолчанию", verdict, decided)
+	}
+}
+
+// TestConnectDeniedByACL проверяет, что на запрещённый правилами CONNECT клиент
+// получает ответ 0x02, а соединение с целью не устанавливается
+func TestConnectDeniedByACL(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config = defaultConfig()
+	config.ACL = ACLConfig{Default: aclAllow, Rules: []ACLRule{{Action: aclDeny, Networks: []string{"203.0.113.0/24"}}}}
+	if err := compileACL(config.ACL.Rules); err != nil {
+		t.Fatalf("compileACL: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	sess := &session{conn: server, clientIP: "127.0.0.1", listener: &proxyListener{name: "test"}, closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		done <- handleConnectCommand(server, sess, "203.0.113.7", 80)
+		server.Close()
+	}()
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("чтение ответа: %v", err)
+	}
+	if reply[0] != socks5Version || reply[1] != replyNotAllowed {
+		t.Errorf("ответ %x, ожидался код 0x02", reply[:2])
+	}
+	if err := <-done; !errors.Is(err, errDestinationDenied) {
+		t.Errorf("handleConnectCommand: %v, ожидалась errDestinationDenied", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// authPolicy определяет, какие методы аутентификации доступны клиенту
+type authPolicy struct {
+	noAuthAll  bool // Вход без аутентификации разрешён всем клиентам слушателя
+	noAuthNets []*net.IPNet
+	noAuthUser string
+}
+
+// newAuthPolicy разбирает секцию auth и создаёт политику аутентификации
+func newAuthPolicy(cfg AuthConfig) (*authPolicy, error) {
+	p := &authPolicy{noAuthAll: cfg.NoAuth, noAuthUser: cfg.NoAuthUser}
+	for _, cidr := range cfg.NoAuthNetworks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("некорректная сеть %q в списке без аутентификации: %w", cidr, err)
+		}
+		p.noAuthNets = append(p.noAuthNets, ipNet)
+	}
+	if (p.noAuthAll || len(p.noAuthNets) > 0) && p.noAuthUser == "" {
+		return nil, fmt.Errorf("не задан псевдопользователь для сессий без аутентификации")
+	}
+	return p, nil
+}
+
+// allowsNoAuth сообщает, разрешён ли клиенту с адресом clientIP вход без аутентификации
+func (p *authPolicy) allowsNoAuth(clientIP string) bool {
+	if p.noAuthAll {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range p.noAuthNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectMethod выбирает метод аутентификации из предложенных клиентом.
+// Возвращает 0xFF, если ни один метод не подходит.
+func (p *authPolicy) selectMethod(methods []byte, clientIP string) byte {
+	offered := func(m byte) bool {
+		for _, method := range methods {
+			if method == m {
+				return true
+			}
+		}
+		return false
+	}
+
+	if offered(noAuthRequired) && p.allowsNoAuth(clientIP) {
+		return noAuthRequired
+	}
+	if offered(usernamePasswordAuth) {
+		return usernamePasswordAuth
+	}
+	return noAcceptableMethods
+}
+
+// describe возвращает описание политики для журнала запуска
+func (p *authPolicy) describe() string {
+	switch {
+	case p.noAuthAll:
+		return fmt.Sprintf(" без аутентификации (пользователь %s)", p.noAuthUser)
+	case len(p.noAuthNets) > 0:
+		nets := make([]string, len(p.noAuthNets))
+		for i, n := range p.noAuthNets {
+			nets[i] = n.String()
+		}
+		return fmt.Sprintf(" с аутентификацией логин/пароль, без неё из сетей %v (пользователь %s)", nets, p.noAuthUser)
+	default:
+		return " с аутентификацией логин/пароль"
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"time"
+)
+
+// handleBindCommand обрабатывает команду BIND: открывает порт для входящего соединения,
+// сообщает его клиенту первым ответом, а после подключения удалённой стороны - вторым
+func handleBindCommand(conn net.Conn, sess *session, destAddr string, destPort int) error {
+	expectedIPs, err := resolveBindPeer(destAddr)
+	if err != nil {
+		_ = writeSocks5Reply(conn, replyHostUnreachable, nil)
+		return err
+	}
+
+	// Слушаем на том же локальном адресе, на который пришло управляющее соединение
+	var localIP net.IP
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	listener, err := listenBindPort(localIP)
+	if err != nil {
+		_ = writeSocks5Reply(conn, replyGeneralFailure, nil)
+		return fmt.Errorf("не удалось открыть порт для BIND: %w", err)
+	}
+	defer listener.Close()
+	sess.addPeer(listener) // Закрытие сессии прерывает ожидание входящего соединения
+
+	if err := writeSocks5Reply(conn, replySuccess, listener.Addr()); err != nil {
+		return fmt.Errorf("ошибка отправки первого ответа на BIND: %w", err)
+	}
+	log.Printf("BIND: пользователь %s (%s) ожидает входящее соединение на %s", sess.username, conn.RemoteAddr(), listener.Addr())
+
+	_ = listener.SetDeadline(time.Now().Add(config.Bind.AcceptTimeout))
+	var peerConn net.Conn
+	for {
+		peerConn, err = listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				_ = writeSocks5Reply(conn, replyTTLExpired, nil)
+				return fmt.Errorf("BIND: входящее соединение не поступило за %s", config.Bind.AcceptTimeout)
+			}
+			_ = writeSocks5Reply(conn, replyGeneralFailure, nil)
+			return fmt.Errorf("BIND: ошибка приёма входящего соединения: %w", err)
+		}
+		if bindPeerAllowed(peerConn.RemoteAddr(), expectedIPs) {
+			break
+		}
+		log.Printf("BIND: отклонено входящее соединение от %s (ожидался %s)", peerConn.RemoteAddr(), destAddr)
+		peerConn.Close()
+	}
+	defer peerConn.Close()
+	listener.Close()
+
+	if err := writeSocks5Reply(conn, replySuccess, peerConn.RemoteAddr()); err != nil {
+		return fmt.Errorf("ошибка отправки второго ответа на BIND: %w", err)
+	}
+	log.Printf("BIND: пользователь %s (%s) получил входящее соединение от %s", sess.username, conn.RemoteAddr(), peerConn.RemoteAddr())
+
+	return proxyData(sess, conn, peerConn)
+}
+
+// listenBindPort открывает TCP-порт из диапазона bind.portRangeStart..bind.portRangeEnd
+func listenBindPort(ip net.IP) (*net.TCPListener, error) {
+	start, end := config.Bind.PortRangeStart, config.Bind.PortRangeEnd
+	if start == 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+
+	size := end - start + 1
+	offset := rand.IntN(size)
+	var lastErr error
+	for i := 0; i < size; i++ {
+		port := start + (offset+i)%size
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("нет свободных портов в диапазоне %d-%d: %w", start, end, lastErr)
+}
+
+// resolveBindPeer возвращает IP-адреса, с которых ожидается входящее соединение.
+// Пустой результат означает, что принимается соединение с любого адреса. Если имя
+// не разрешается, BIND отклоняется: иначе порт принял бы соединение от кого угодно.
+func resolveBindPeer(destAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil
+		}
+		return []net.IP{ip}, nil
+	}
+	ctx, cancel := connectContext()
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", destAddr)
+	if err != nil {
+		return nil, fmt.Errorf("BIND: не удалось разрешить адрес ожидаемой стороны %s: %w", destAddr, connectTimeout(err))
+	}
+	return ips, nil
+}
+
+// bindPeerAllowed проверяет адрес подключившейся стороны по DST.ADDR из запроса BIND
+func bindPeerAllowed(addr net.Addr, expected []net.IP) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	peerIP := net.ParseIP(host)
+	for _, ip := range expected {
+		if ip.Equal(peerIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// bindPortRangeString возвращает диапазон портов BIND для логов
+func bindPortRangeString() string {
+	if config.Bind.PortRangeStart == 0 {
+		return "любой"
+	}
+	return strconv.Itoa(config.Bind.PortRangeStart) + "-" + strconv.Itoa(config.Bind.PortRangeEnd)
+}
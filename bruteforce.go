@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// authBackoffBase и authBackoffMax - задержка ответа на неудачный вход: удваивается
+	// с каждой неудачей подряд с того же адреса или в ту же учётную запись
+	authBackoffBase = 250 * time.Millisecond
+	authBackoffMax  = 5 * time.Second
+
+	// banFileCheckInterval - как часто проверяется изменение файла блокировок (команда unban)
+	banFileCheckInterval = 5 * time.Second
+)
+
+// errUserLocked возвращается при входе в учётную запись, временно заблокированную после подбора пароля
+var errUserLocked = errors.New("учётная запись временно заблокирована после неудачных попыток входа")
+
+// BruteForceConfig задаёт защиту от подбора паролей (секция bruteForce)
+type BruteForceConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	MaxIPFailures   int           `yaml:"maxIPFailures"`   // Неудачных входов с адреса за window до блокировки адреса
+	MaxUserFailures int           `yaml:"maxUserFailures"` // Неудачных входов в учётную запись за window до её блокировки; 0 - не блокировать
+	Window          time.Duration `yaml:"window"`          // Окно подсчёта неудачных входов
+	BanDuration     time.Duration `yaml:"banDuration"`     // Первая блокировка; каждая следующая подряд вдвое дольше
+	MaxBanDuration  time.Duration `yaml:"maxBanDuration"`  // Предел длительности блокировки
+	BanFile         string        `yaml:"banFile"`         // Файл, в котором блокировки переживают перезапуск
+	ExemptNetworks  []string      `yaml:"exemptNetworks"`  // Сети, адреса из которых не блокируются
+
+	exempt []*net.IPNet
+}
+
+// validate проверяет настройки и разбирает сети-исключения
+func (c *BruteForceConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxIPFailures <= 0 || c.MaxUserFailures < 0 {
+		return fmt.Errorf("maxIPFailures должен быть больше нуля, maxUserFailures - не меньше нуля")
+	}
+	if c.Window <= 0 || c.BanDuration <= 0 || c.MaxBanDuration < c.BanDuration {
+		return fmt.Errorf("window и banDuration должны быть больше нуля, maxBanDuration - не меньше banDuration")
+	}
+	if c.BanFile == "" {
+		return fmt.Errorf("не задан файл блокировок banFile")
+	}
+	c.exempt = nil
+	for _, s := range c.ExemptNetworks {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return fmt.Errorf("exemptNetworks: %w", err)
+		}
+		c.exempt = append(c.exempt, ipNet)
+	}
+	return nil
+}
+
+// AuthFailureStats - неудачные входы и блокировки с момента запуска для статистики
+type AuthFailureStats struct {
+	Total               int64            `json:"total"`
+	ByUser              map[string]int64 `json:"byUser"`              // По существующим учётным записям
+	UnknownUser         int64            `json:"unknownUser"`         // Попытки с несуществующими именами
+	RejectedConnections int64            `json:"rejectedConnections"` // Соединения с заблокированных адресов
+	RejectedLogins      int64            `json:"rejectedLogins"`      // Попытки входа в заблокированные учётные записи
+	BannedIPs           []string         `json:"bannedIPs"`           // Заблокированные сейчас адреса
+	LockedUsers         []string         `json:"lockedUsers"`         // Заблокированные сейчас учётные записи
+}
+
+// BanList - содержимое файла блокировок
+type BanList struct {
+	IPs   map[string]*BanEntry `json:"ips"`
+	Users map[string]*BanEntry `json:"users"`
+}
+
+// BanEntry - действующая блокировка адреса или учётной записи
+type BanEntry struct {
+	Until time.Time `json:"until"`
+	Bans  int       `json:"bans"`          // Номер блокировки подряд; определяет длительность следующей
+	IPs   []string  `json:"ips,omitempty"` // Для учётной записи - адреса, с которых вход заблокирован
+}
+
+// failureTracker - неудачные входы и блокировки одного адреса или учётной записи
+type failureTracker struct {
+	failures    int // Неудачных входов в текущем окне
+	windowStart time.Time
+	bans        int // Блокировок подряд
+	bannedUntil time.Time
+
+	// Только для учётных записей: адреса с неудачными входами в текущем окне и адреса,
+	// на которые распространяется блокировка. С остальных адресов вход возможен.
+	sources    map[string]bool
+	lockedFrom map[string]bool
+}
+
+var (
+	ipFailures      = make(map[string]*failureTracker) // key: IP клиента
+	userFailures    = make(map[string]*failureTracker) // key: имя существующего пользователя
+	authStats       = AuthFailureStats{ByUser: make(map[string]int64)}
+	banFileLastStat fileStat   // Состояние файла блокировок после последней записи или чтения
+	banFileLast     BanList    // Блокировки, записанные в файл или прочитанные из него последними
+	bruteForceMutex sync.Mutex // Мьютекс для доступа к ipFailures, userFailures, authStats, banFileLastStat и banFileLast
+
+	banFileMutex sync.Mutex // Не даёт записи и перечитыванию файла блокировок идти одновременно
+)
+
+// banned сообщает, действует ли блокировка
+func (t *failureTracker) banned(now time.Time) bool {
+	return now.Before(t.bannedUntil)
+}
+
+// fail учитывает неудачный вход с адреса source (пусто - адрес не учитывается).
+// При достижении limit (0 - без блокировки) включает блокировку и возвращает её длительность.
+// Блокировка учётной записи распространяется на адреса, с которых были неудачи.
+func (t *failureTracker) fail(now time.Time, limit int, source string) time.Duration {
+	cfg := &config.BruteForce
+	if now.Sub(t.windowStart) > cfg.Window {
+		t.failures, t.windowStart, t.sources = 0, now, nil
+	}
+	if t.bans > 0 && now.Sub(t.bannedUntil) > cfg.MaxBanDuration {
+		t.bans = 0 // Давно не блокировался - следующая блокировка снова короткая
+	}
+	if source != "" {
+		if t.sources == nil {
+			t.sources = make(map[string]bool)
+		}
+		t.sources[source] = true
+		if t.banned(now) {
+			t.lockedFrom[source] = true // Подбор продолжается с нового адреса
+		}
+	}
+	t.failures++
+	if limit <= 0 || t.failures < limit {
+		return 0
+	}
+
+	if !t.banned(now) {
+		t.lockedFrom = make(map[string]bool)
+	}
+	for ip := range t.sources {
+		t.lockedFrom[ip] = true
+	}
+	t.sources = nil
+
+	t.bans++
+	d := cfg.BanDuration
+	for i := 1; i < t.bans && d < cfg.MaxBanDuration; i++ {
+		d *= 2
+	}
+	d = min(d, cfg.MaxBanDuration)
+	t.bannedUntil = now.Add(d)
+	t.failures = 0
+	return d
+}
+
+// backoff возвращает задержку ответа после очередной неудачи
+func (t *failureTracker) backoff() time.Duration {
+	d := authBackoffBase
+	for i := 1; i < t.failures && d < authBackoffMax; i++ {
+		d *= 2
+	}
+	return min(d, authBackoffMax)
+}
+
+// trackedIP возвращает IP клиента, если его неудачные входы нужно учитывать
+func trackedIP(clientIP string) (string, bool) {
+	ip := net.ParseIP(clientIP)
+	if ip == nil || networksContain(config.BruteForce.exempt, ip) {
+		return "", false // Unix-сокет или сеть-исключение
+	}
+	return ip.String(), true
+}
+
+// trackerLocked возвращает счётчик из m, создавая его при необходимости. Вызывается под bruteForceMutex.
+func trackerLocked(m map[string]*failureTracker, key string) *failureTracker {
+	t, ok := m[key]
+	if !ok {
+		t = &failureTracker{}
+		m[key] = t
+	}
+	return t
+}
+
+// rejectBannedConn закрывает только что принятое соединение с заблокированного адреса.
+// Вызывается до запуска обработчика, поэтому такие соединения не занимают ресурсов.
+func rejectBannedConn(conn net.Conn) bool {
+	if !config.BruteForce.Enabled {
+		return false
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	bruteForceMutex.Lock()
+	t, found := ipFailures[addr.IP.String()]
+	banned := found && t.banned(time.Now())
+	if banned {
+		authStats.RejectedConnections++
+	}
+	bruteForceMutex.Unlock()
+
+	if banned {
+		conn.Close()
+	}
+	return banned
+}
+
+// checkLogin проверяет логин и пароль с учётом защиты от подбора: вход в учётную запись,
+// заблокированную для адреса клиента, отклоняется, неверный пароль учитывается и ответ
+// на него задерживается. Пароль проверяется и при блокировке, а ответ задерживается
+// так же, как при неудаче, чтобы по времени ответа нельзя было узнать о блокировке.
+func checkLogin(clientIP, username, password string) error {
+	locked, delay := userLocked(clientIP, username)
+	err := verifyCredentials(username, password)
+	if locked {
+		time.Sleep(delay)
+		return errUserLocked
+	}
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		time.Sleep(recordAuthFailure(clientIP, username))
+	case err == nil:
+		recordAuthSuccess(clientIP, username)
+	}
+	return err
+}
+
+// userLocked сообщает, заблокирована ли учётная запись для адреса clientIP. Отклонённая
+// попытка учитывается как неудача адреса, задержка ответа на неё возвращается.
+func userLocked(clientIP, username string) (bool, time.Duration) {
+	if !config.BruteForce.Enabled {
+		return false, 0
+	}
+	ip, tracked := trackedIP(clientIP)
+	if !tracked {
+		return false, 0
+	}
+	changed := false
+	defer func() {
+		if changed {
+			saveBanFile()
+		}
+	}()
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	now := time.Now()
+	t, ok := userFailures[username]
+	if !ok || !t.banned(now) || !t.lockedFrom[ip] {
+		return false, 0
+	}
+	authStats.RejectedLogins++
+	ipTracker := trackerLocked(ipFailures, ip)
+	if d := ipTracker.fail(now, config.BruteForce.MaxIPFailures, ""); d > 0 {
+		log.Printf("Адрес %s заблокирован на %s после %d неудачных попыток входа (блокировка %d подряд)", ip, d, config.BruteForce.MaxIPFailures, ipTracker.bans)
+		changed = true
+	}
+	return true, max(ipTracker.backoff(), t.backoff())
+}
+
+// recordAuthFailure учитывает неудачный вход с адреса clientIP в учётную запись username,
+// блокирует адрес или учётную запись при превышении порогов и возвращает задержку ответа
+func recordAuthFailure(clientIP, username string) time.Duration {
+	usersMutex.RLock()
+	_, known := users[username]
+	usersMutex.RUnlock()
+
+	changed := false
+	defer func() {
+		if changed {
+			saveBanFile() // После освобождения bruteForceMutex
+		}
+	}()
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	authStats.Total++
+	if known {
+		authStats.ByUser[username]++
+	} else {
+		authStats.UnknownUser++
+	}
+	if !config.BruteForce.Enabled {
+		return 0
+	}
+
+	now := time.Now()
+	var delay time.Duration
+	ip, tracked := trackedIP(clientIP)
+	if tracked {
+		t := trackerLocked(ipFailures, ip)
+		if d := t.fail(now, config.BruteForce.MaxIPFailures, ""); d > 0 {
+			log.Printf("Адрес %s заблокирован на %s после %d неудачных попыток входа (блокировка %d подряд)", ip, d, config.BruteForce.MaxIPFailures, t.bans)
+			changed = true
+		}
+		delay = t.backoff()
+	}
+	// Учётные записи отслеживаются только существующие, иначе перебор имён раздувает таблицу
+	if known {
+		t := trackerLocked(userFailures, username)
+		wasLocked := len(t.lockedFrom)
+		if d := t.fail(now, config.BruteForce.MaxUserFailures, ip); d > 0 {
+			log.Printf("Учётная запись %s временно заблокирована на %s после %d неудачных попыток входа (адресов: %d)", username, d, config.BruteForce.MaxUserFailures, len(t.lockedFrom))
+			changed = true
+		} else if len(t.lockedFrom) != wasLocked {
+			changed = true
+		}
+		delay = max(delay, t.backoff())
+	}
+	return delay
+}
+
+// recordAuthSuccess сбрасывает счётчики неудач после успешного входа
+func recordAuthSuccess(clientIP, username string) {
+	if !config.BruteForce.Enabled {
+		return
+	}
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	if ip, ok := trackedIP(clientIP); ok {
+		if t, found := ipFailures[ip]; found {
+			t.failures = 0
+		}
+	}
+	if t, found := userFailures[username]; found {
+		t.failures = 0
+	}
+}
+
+// banListLocked собирает действующие блокировки. Вызывается под bruteForceMutex.
+func banListLocked(now time.Time) BanList {
+	list := BanList{IPs: make(map[string]*BanEntry), Users: make(map[string]*BanEntry)}
+	for ip, t := range ipFailures {
+		if t.banned(now) {
+			list.IPs[ip] = &BanEntry{Until: t.bannedUntil, Bans: t.bans}
+		}
+	}
+	for username, t := range userFailures {
+		if t.banned(now) {
+			ips := make([]string, 0, len(t.lockedFrom))
+			for ip := range t.lockedFrom {
+				ips = append(ips, ip)
+			}
+			sort.Strings(ips)
+			list.Users[username] = &BanEntry{Until: t.bannedUntil, Bans: t.bans, IPs: ips}
+		}
+	}
+	return list
+}
+
+// saveBanFile записывает действующие блокировки в файл. Список копируется под
+// bruteForceMutex, а запись на диск идёт без него, чтобы проверки входа не ждали диска.
+// Если файл изменила команда unban, её изменения сначала применяются к списку в памяти.
+func saveBanFile() {
+	banFileMutex.Lock()
+	defer banFileMutex.Unlock()
+
+	path := config.BruteForce.BanFile
+	unlock, err := lockBanFile(path)
+	if err != nil {
+		log.Printf("Ошибка при записи списка блокировок: %v", err)
+		return
+	}
+	defer unlock()
+
+	bruteForceMutex.Lock()
+	changed := statFile(path) != banFileLastStat
+	bruteForceMutex.Unlock()
+	if changed {
+		if err := reloadBanFileLocked(); err != nil {
+			log.Printf("Ошибка загрузки списка блокировок: %v", err)
+		}
+	}
+
+	bruteForceMutex.Lock()
+	list := banListLocked(time.Now())
+	bruteForceMutex.Unlock()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Printf("Ошибка при кодировании списка блокировок: %v", err)
+		return
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		log.Printf("Ошибка при записи списка блокировок в файл %s: %v", path, err)
+		return
+	}
+	stat := statFile(path)
+
+	bruteForceMutex.Lock()
+	banFileLastStat, banFileLast = stat, list
+	bruteForceMutex.Unlock()
+}
+
+// lockBanFile берёт исключительную блокировку файла banFile.lock, чтобы сервер и
+// команда unban не переписывали файл блокировок одновременно. Возвращает функцию,
+// снимающую блокировку.
+func lockBanFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть %s.lock: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("не удалось заблокировать %s.lock: %w", path, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// readBanFile читает файл блокировок; отсутствующий файл - пустой список
+func readBanFile(path string) (BanList, error) {
+	list := BanList{IPs: make(map[string]*BanEntry), Users: make(map[string]*BanEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return list, fmt.Errorf("ошибка чтения файла блокировок %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return list, fmt.Errorf("ошибка декодирования файла блокировок %s: %w", path, err)
+	}
+	if list.IPs == nil {
+		list.IPs = make(map[string]*BanEntry)
+	}
+	if list.Users == nil {
+		list.Users = make(map[string]*BanEntry)
+	}
+	return list, nil
+}
+
+// loadBanFile применяет блокировки из файла. Вызывается при запуске.
+func loadBanFile() error {
+	banFileMutex.Lock()
+	defer banFileMutex.Unlock()
+	return reloadBanFileLocked()
+}
+
+// reloadBanFileLocked применяет изменения файла блокировок к списку в памяти. Записи,
+// удалённые из файла командой unban, снимают блокировку; блокировки, появившиеся
+// в памяти после последней записи файла, сохраняются. Вызывается под banFileMutex.
+func reloadBanFileLocked() error {
+	path := config.BruteForce.BanFile
+	stat := statFile(path)
+	list, err := readBanFile(path)
+	if err != nil {
+		return err
+	}
+
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	apply := func(m map[string]*failureTracker, entries, last map[string]*BanEntry) int {
+		for key, old := range last {
+			if _, ok := entries[key]; !ok {
+				// Блокировку, продлённую после последней записи файла, unban не снимал
+				if t, found := m[key]; found && !t.bannedUntil.After(old.Until) {
+					t.bannedUntil, t.bans, t.lockedFrom = time.Time{}, 0, nil
+				}
+			}
+		}
+		active := 0
+		for key, e := range entries {
+			t := trackerLocked(m, key)
+			if e.Until.After(t.bannedUntil) {
+				t.bannedUntil, t.bans = e.Until, e.Bans
+			}
+			if len(e.IPs) > 0 && t.lockedFrom == nil {
+				t.lockedFrom = make(map[string]bool, len(e.IPs))
+			}
+			for _, ip := range e.IPs {
+				t.lockedFrom[ip] = true
+			}
+			if t.banned(time.Now()) {
+				active++
+			}
+		}
+		return active
+	}
+	ips := apply(ipFailures, list.IPs, banFileLast.IPs)
+	locked := apply(userFailures, list.Users, banFileLast.Users)
+	banFileLastStat, banFileLast = stat, list
+	if ips+locked > 0 {
+		log.Printf("Загружен список блокировок из %s: адресов %d, учётных записей %d", path, ips, locked)
+	}
+	return nil
+}
+
+// watchBanFile перечитывает файл блокировок, когда его изменили извне (команда unban),
+// и удаляет из памяти счётчики, которые больше ничего не значат
+func watchBanFile() {
+	ticker := time.NewTicker(banFileCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		banFileMutex.Lock()
+		bruteForceMutex.Lock()
+		changed := statFile(config.BruteForce.BanFile) != banFileLastStat
+		bruteForceMutex.Unlock()
+		if changed {
+			log.Printf("Файл блокировок %s изменён, перечитываем", config.BruteForce.BanFile)
+			if err := reloadBanFileLocked(); err != nil {
+				log.Printf("Ошибка загрузки списка блокировок: %v", err)
+			}
+		}
+		banFileMutex.Unlock()
+		pruneFailureTrackers()
+	}
+}
+
+// pruneFailureTrackers удаляет счётчики без действующих блокировок и свежих неудач
+func pruneFailureTrackers() {
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	now := time.Now()
+	for _, m := range []map[string]*failureTracker{ipFailures, userFailures} {
+		for key, t := range m {
+			stale := now.Sub(t.windowStart) > config.BruteForce.Window
+			forgiven := t.bans == 0 || now.Sub(t.bannedUntil) > config.BruteForce.MaxBanDuration
+			if !t.banned(now) && stale && forgiven {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// authFailureStats возвращает копию счётчиков неудачных входов и действующие блокировки
+func authFailureStats() *AuthFailureStats {
+	bruteForceMutex.Lock()
+	defer bruteForceMutex.Unlock()
+
+	stats := authStats
+	stats.ByUser = make(map[string]int64, len(authStats.ByUser))
+	for username, n := range authStats.ByUser {
+		stats.ByUser[username] = n
+	}
+	list := banListLocked(time.Now())
+	stats.BannedIPs = sortedKeys(list.IPs)
+	stats.LockedUsers = sortedKeys(list.Users)
+	return &stats
+}
+
+// sortedKeys возвращает ключи списка блокировок по алфавиту
+func sortedKeys(m map[string]*BanEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// runUnban реализует подкоманду unban: снимает блокировку адреса или учётной записи
+// в файле блокировок. Файл меняется под блокировкой banFile.lock, которую берёт и
+// работающий прокси перед записью; изменение он замечает сам.
+func runUnban(args []string) error {
+	fs := flag.NewFlagSet("unban", flag.ContinueOnError)
+	opts := &cliOptions{}
+	fs.StringVar(&opts.configPath, "config", "", "Путь к файлу конфигурации YAML (по умолчанию "+defaultConfigPath+")")
+	user := fs.Bool("user", false, "Снять блокировку учётной записи, а не адреса")
+	list := fs.Bool("list", false, "Показать действующие блокировки")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Использование: unban [-config путь] [-user] адрес|имя ... или unban -list")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg, _, err := loadConfig(opts, set)
+	if err != nil {
+		return err
+	}
+	path := cfg.BruteForce.BanFile
+	if !*list {
+		unlock, err := lockBanFile(path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	bans, err := readBanFile(path)
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		now := time.Now()
+		for _, ip := range sortedKeys(bans.IPs) {
+			if e := bans.IPs[ip]; now.Before(e.Until) {
+				fmt.Printf("адрес %s до %s\n", ip, e.Until.Local().Format(time.DateTime))
+			}
+		}
+		for _, username := range sortedKeys(bans.Users) {
+			if e := bans.Users[username]; now.Before(e.Until) {
+				fmt.Printf("учётная запись %s до %s\n", username, e.Until.Local().Format(time.DateTime))
+			}
+		}
+		return nil
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("не указано, что разблокировать")
+	}
+
+	removed := 0
+	for _, key := range fs.Args() {
+		m := bans.IPs
+		if *user {
+			m = bans.Users
+		} else if ip := net.ParseIP(key); ip != nil {
+			key = ip.String()
+		}
+		if _, ok := m[key]; !ok {
+			fmt.Printf("%s не заблокирован\n", key)
+			continue
+		}
+		delete(m, key)
+		removed++
+		fmt.Printf("%s разблокирован\n", key)
+	}
+	if removed == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка кодирования JSON: %w", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
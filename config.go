@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigPath - файл конфигурации по умолчанию; если его нет, используются встроенные значения
+const defaultConfigPath = "/etc/astra_socks_eliza/config.yaml"
+
+// Config описывает настройки прокси-сервера (файл YAML, флаги и переменные окружения)
+type Config struct {
+	Listen        string        `yaml:"listen"`        // Адрес SOCKS5 прокси, если список listeners пуст
+	StatsFile     string        `yaml:"statsFile"`     // Путь к файлу статистики
+	UsersFile     string        `yaml:"usersFile"`     // Путь к файлу пользователей
+	GeoIPDB       string        `yaml:"geoipDB"`       // Путь к GeoIP базе данных
+	StatsInterval time.Duration `yaml:"statsInterval"` // Период сохранения статистики
+	StatsBackups  int           `yaml:"statsBackups"`  // Сколько предыдущих снимков статистики хранить (statsFile.1 ... statsFile.N)
+
+	Listeners []ListenerConfig `yaml:"listeners"`
+	Users     UsersConfig      `yaml:"users"`
+	Quota     QuotaConfig      `yaml:"quota"`
+	Shutdown  ShutdownConfig   `yaml:"shutdown"`
+	Auth      AuthConfig       `yaml:"auth"`
+	Protocols ProtocolsConfig  `yaml:"protocols"`
+	RateLimit RateLimit        `yaml:"rateLimit"` // Общие ограничения скорости и ограничения на соединение по умолчанию
+	ACL       ACLConfig        `yaml:"acl"`       // Правила доступа к адресам назначения
+	Bind      BindConfig       `yaml:"bind"`
+	UDP       UDPConfig        `yaml:"udp"`
+
+	ProtectedNetworks ProtectedNetworksConfig `yaml:"protectedNetworks"` // Защита внутренних сетей от доступа через прокси
+	BruteForce        BruteForceConfig        `yaml:"bruteForce"`        // Защита от подбора паролей
+	Timeouts          TimeoutsConfig          `yaml:"timeouts"`          // Таймауты этапов сессии
+	Limits            LimitsConfig            `yaml:"limits"`            // Ограничения приёма соединений
+}
+
+// ListenerConfig описывает одну точку входа прокси
+type ListenerConfig struct {
+	Name       string      `yaml:"name"`       // Метка для статистики
+	Network    string      `yaml:"network"`    // tcp (по умолчанию), tcp4, tcp6 или unix
+	Address    string      `yaml:"address"`    // host:port или путь к Unix-сокету
+	SocketMode string      `yaml:"socketMode"` // Права на Unix-сокет, например "0660"
+	Auth       *AuthConfig `yaml:"auth"`       // Своя политика аутентификации вместо общей секции auth
+	ACL        []ACLRule   `yaml:"acl"`        // Правила доступа точки входа; проверяются после правил пользователя и до общих
+}
+
+// AuthConfig задаёт политику выбора метода аутентификации
+type AuthConfig struct {
+	NoAuth         bool     `yaml:"noAuth"`         // Разрешить метод 0x00 всем клиентам
+	NoAuthNetworks []string `yaml:"noAuthNetworks"` // CIDR, клиентам из которых разрешён метод 0x00
+	NoAuthUser     string   `yaml:"noAuthUser"`     // Псевдопользователь для сессий без аутентификации
+}
+
+// UsersConfig задаёт перезагрузку файла пользователей
+type UsersConfig struct {
+	ReloadInterval    time.Duration `yaml:"reloadInterval"`    // Период проверки изменений файла; 0 - только по SIGHUP
+	TerminateSessions bool          `yaml:"terminateSessions"` // Закрывать сессии удалённых и отключённых пользователей
+	OnLimit           string        `yaml:"onLimit"`           // Превышение maxConnections/maxSourceIPs: reject-newest или evict-oldest
+	TerminateExpired  bool          `yaml:"terminateExpired"`  // Закрывать сессии по окончании срока действия или интервала расписания
+}
+
+// QuotaConfig - общие настройки квот трафика (сами квоты задаются в users.json)
+type QuotaConfig struct {
+	TerminateSessions bool `yaml:"terminateSessions"` // Закрывать открытые сессии пользователя, исчерпавшего квоту
+}
+
+// ShutdownConfig задаёт поведение при остановке по SIGTERM/SIGINT
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drainTimeout"` // Сколько ждать завершения активных сессий
+}
+
+// ProtocolsConfig включает дополнительные протоколы на порту прокси
+type ProtocolsConfig struct {
+	SOCKS4    bool `yaml:"socks4"`
+	HTTPProxy bool `yaml:"httpProxy"`
+}
+
+// BindConfig задаёт параметры команды BIND
+type BindConfig struct {
+	PortRangeStart int           `yaml:"portRangeStart"` // 0 - порт выбирает ОС
+	PortRangeEnd   int           `yaml:"portRangeEnd"`
+	AcceptTimeout  time.Duration `yaml:"acceptTimeout"`
+}
+
+// UDPConfig задаёт параметры UDP ASSOCIATE
+type UDPConfig struct {
+	ReassemblyTimeout time.Duration `yaml:"reassemblyTimeout"` // Таймер сборки фрагментов
+}
+
+// config - действующая конфигурация; заполняется в main до запуска сервера
+var config = defaultConfig()
+
+// defaultConfig возвращает встроенные значения по умолчанию
+func defaultConfig() *Config {
+	return &Config{
+		Listen:        "0.0.0.0:7777",
+		StatsFile:     "/var/lib/astra_socks_eliza/stats.json",
+		UsersFile:     "/etc/astra_socks_eliza/users.json",
+		GeoIPDB:       "/usr/share/GeoIP/GeoLite2-Country.mmdb",
+		StatsInterval: 5 * time.Second,
+		StatsBackups:  3,
+		Users: UsersConfig{
+			ReloadInterval: 5 * time.Second,
+			OnLimit:        limitRejectNewest,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: 30 * time.Second,
+		},
+		ACL: ACLConfig{
+			Default: aclAllow,
+		},
+		ProtectedNetworks: ProtectedNetworksConfig{
+			Enabled: true,
+		},
+		BruteForce: BruteForceConfig{
+			Enabled:         true,
+			MaxIPFailures:   10,
+			MaxUserFailures: 20,
+			Window:          10 * time.Minute,
+			BanDuration:     5 * time.Minute,
+			MaxBanDuration:  24 * time.Hour,
+			BanFile:         "/var/lib/astra_socks_eliza/bans.json",
+		},
+		Timeouts: TimeoutsConfig{
+			Handshake: 10 * time.Second,
+			Auth:      15 * time.Second,
+			Connect:   10 * time.Second,
+		},
+		Limits: LimitsConfig{
+			MaxConnections:       10000,
+			MaxConnectionsPerIP:  256,
+			MaxPendingHandshakes: 1024,
+			OnLimit:              acceptReject,
+			QueueTimeout:         5 * time.Second,
+		},
+		Auth: AuthConfig{
+			NoAuthUser: "anonymous",
+		},
+		Protocols: ProtocolsConfig{
+			SOCKS4:    false,
+			HTTPProxy: true,
+		},
+		Bind: BindConfig{
+			AcceptTimeout: 2 * time.Minute,
+		},
+		UDP: UDPConfig{
+			ReassemblyTimeout: 5 * time.Second,
+		},
+	}
+}
+
+// cliOptions - флаги командной строки
+type cliOptions struct {
+	configPath    string
+	checkConfig   bool
+	listen        string
+	statsFile     string
+	usersFile     string
+	geoIPDB       string
+	statsInterval time.Duration
+}
+
+// parseFlags разбирает флаги командной строки. Возвращает также множество явно заданных флагов.
+func parseFlags(args []string) (*cliOptions, map[string]bool, error) {
+	opts := &cliOptions{}
+	fs := flag.NewFlagSet("astra_socks_eliza", flag.ContinueOnError)
+	fs.StringVar(&opts.configPath, "config", "", "Путь к файлу конфигурации YAML (по умолчанию "+defaultConfigPath+")")
+	fs.BoolVar(&opts.checkConfig, "check-config", false, "Проверить конфигурацию и выйти")
+	fs.StringVar(&opts.listen, "listen", "", "Адрес SOCKS5 прокси")
+	fs.StringVar(&opts.statsFile, "stats-file", "", "Путь к файлу статистики JSON")
+	fs.StringVar(&opts.usersFile, "users-file", "", "Путь к файлу пользователей JSON")
+	fs.StringVar(&opts.geoIPDB, "geoip-db", "", "Путь к GeoIP базе данных")
+	fs.DurationVar(&opts.statsInterval, "stats-interval", 0, "Период сохранения статистики")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return opts, set, nil
+}
+
+// loadConfig собирает конфигурацию: значения по умолчанию, затем файл,
+// затем переменные окружения и, наконец, флаги командной строки
+func loadConfig(opts *cliOptions, setFlags map[string]bool) (*Config, string, error) {
+	cfg := defaultConfig()
+
+	path, explicit := opts.configPath, setFlags["config"]
+	if !explicit {
+		if env, ok := os.LookupEnv("ELIZA_CONFIG"); ok {
+			path, explicit = env, true
+		} else {
+			path = defaultConfigPath
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := decodeConfig(data, cfg); err != nil {
+			return nil, path, fmt.Errorf("ошибка разбора файла конфигурации %s: %w", path, err)
+		}
+	case os.IsNotExist(err) && !explicit:
+		path = "" // Файл по умолчанию необязателен
+	default:
+		return nil, path, fmt.Errorf("ошибка чтения файла конфигурации %s: %w", path, err)
+	}
+
+	if err := applyEnv(cfg); err != nil {
+		return nil, path, err
+	}
+	applyFlags(cfg, opts, setFlags)
+
+	if err := cfg.validate(); err != nil {
+		return nil, path, err
+	}
+	return cfg, path, nil
+}
+
+// decodeConfig разбирает YAML поверх уже заполненной конфигурации; неизвестные ключи - ошибка
+func decodeConfig(data []byte, cfg *Config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// applyEnv переопределяет настройки переменными окружения ELIZA_*
+func applyEnv(cfg *Config) error {
+	stringVars := map[string]*string{
+		"ELIZA_LISTEN":     &cfg.Listen,
+		"ELIZA_STATS_FILE": &cfg.StatsFile,
+		"ELIZA_USERS_FILE": &cfg.UsersFile,
+		"ELIZA_GEOIP_DB":   &cfg.GeoIPDB,
+	}
+	for name, field := range stringVars {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	if v, ok := os.LookupEnv("ELIZA_STATS_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("некорректное значение ELIZA_STATS_INTERVAL: %w", err)
+		}
+		cfg.StatsInterval = d
+	}
+	return nil
+}
+
+// applyFlags переопределяет настройки явно заданными флагами
+func applyFlags(cfg *Config, opts *cliOptions, set map[string]bool) {
+	if set["listen"] {
+		cfg.Listen = opts.listen
+	}
+	if set["stats-file"] {
+		cfg.StatsFile = opts.statsFile
+	}
+	if set["users-file"] {
+		cfg.UsersFile = opts.usersFile
+	}
+	if set["geoip-db"] {
+		cfg.GeoIPDB = opts.geoIPDB
+	}
+	if set["stats-interval"] {
+		cfg.StatsInterval = opts.statsInterval
+	}
+}
+
+// validate проверяет согласованность настроек
+func (c *Config) validate() error {
+	if len(c.Listeners) == 0 {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("некорректный адрес listen %q: %w", c.Listen, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, l := range c.effectiveListeners() {
+		if l.Name == "" {
+			return fmt.Errorf("listeners[%d]: не задано имя", i)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listeners[%d]: имя %q уже используется", i, l.Name)
+		}
+		names[l.Name] = true
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners[%d] (%s): %w", i, l.Name, err)
+		}
+		if _, err := newAuthPolicy(c.listenerAuth(l)); err != nil {
+			return fmt.Errorf("listeners[%d] (%s): %w", i, l.Name, err)
+		}
+		// effectiveListeners возвращает копии, поэтому правила разбираются прямо в
+		// c.Listeners; у слушателя по умолчанию (без секции listeners) правил нет
+		if i < len(c.Listeners) {
+			if err := compileACL(c.Listeners[i].ACL); err != nil {
+				return fmt.Errorf("listeners[%d] (%s): acl: %w", i, l.Name, err)
+			}
+		}
+	}
+	if c.StatsFile == "" {
+		return fmt.Errorf("не задан путь к файлу статистики (statsFile)")
+	}
+	if c.UsersFile == "" {
+		return fmt.Errorf("не задан путь к файлу пользователей (usersFile)")
+	}
+	if c.StatsInterval <= 0 {
+		return fmt.Errorf("statsInterval должен быть больше нуля")
+	}
+	if c.StatsBackups < 0 {
+		return fmt.Errorf("statsBackups не может быть отрицательным")
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rateLimit: %w", err)
+	}
+	if c.ACL.Default != aclAllow && c.ACL.Default != aclDeny {
+		return fmt.Errorf("acl.default: ожидается %s или %s, получено %q", aclAllow, aclDeny, c.ACL.Default)
+	}
+	if err := compileACL(c.ACL.Rules); err != nil {
+		return fmt.Errorf("acl: %w", err)
+	}
+	if err := c.ProtectedNetworks.compile(); err != nil {
+		return fmt.Errorf("protectedNetworks: %w", err)
+	}
+	if err := c.BruteForce.validate(); err != nil {
+		return fmt.Errorf("bruteForce: %w", err)
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		return fmt.Errorf("timeouts: %w", err)
+	}
+	if err := c.Limits.validate(); err != nil {
+		return fmt.Errorf("limits: %w", err)
+	}
+	if _, err := newAuthPolicy(c.Auth); err != nil {
+		return err
+	}
+	if c.Shutdown.DrainTimeout < 0 {
+		return fmt.Errorf("shutdown.drainTimeout не может быть отрицательным")
+	}
+	if c.Users.ReloadInterval < 0 {
+		return fmt.Errorf("users.reloadInterval не может быть отрицательным")
+	}
+	if c.Users.OnLimit != limitRejectNewest && c.Users.OnLimit != limitEvictOldest {
+		return fmt.Errorf("users.onLimit: ожидается %s или %s, получено %q", limitRejectNewest, limitEvictOldest, c.Users.OnLimit)
+	}
+	if c.Bind.PortRangeStart != 0 || c.Bind.PortRangeEnd != 0 {
+		if c.Bind.PortRangeStart < 1 || c.Bind.PortRangeEnd > 65535 || c.Bind.PortRangeStart > c.Bind.PortRangeEnd {
+			return fmt.Errorf("некорректный диапазон портов BIND %d-%d", c.Bind.PortRangeStart, c.Bind.PortRangeEnd)
+		}
+	}
+	if c.Bind.AcceptTimeout <= 0 {
+		return fmt.Errorf("bind.acceptTimeout должен быть больше нуля")
+	}
+	if c.UDP.ReassemblyTimeout < 5*time.Second {
+		return fmt.Errorf("udp.reassemblyTimeout не может быть меньше 5s (RFC 1928)")
+	}
+	return nil
+}
+
+// effectiveListeners возвращает список точек входа. Если listeners не заданы,
+// используется единственный TCP-слушатель по адресу listen.
+func (c *Config) effectiveListeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{Name: "default", Network: "tcp", Address: c.Listen}}
+	}
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		listeners[i] = l
+	}
+	return listeners
+}
+
+// listenerAuth возвращает политику аутентификации слушателя: свою или общую.
+// Не заданный в своей политике псевдопользователь берётся из общей секции.
+func (c *Config) listenerAuth(l ListenerConfig) AuthConfig {
+	if l.Auth == nil {
+		return c.Auth
+	}
+	auth := *l.Auth
+	if auth.NoAuthUser == "" {
+		auth.NoAuthUser = c.Auth.NoAuthUser
+	}
+	return auth
+}
+
+// validate проверяет адрес и параметры слушателя
+func (l ListenerConfig) validate() error {
+	switch l.Network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("некорректный адрес %q: %w", l.Address, err)
+		}
+		if l.SocketMode != "" {
+			return fmt.Errorf("socketMode применим только к Unix-сокетам")
+		}
+	case "unix":
+		if l.Address == "" {
+			return fmt.Errorf("не задан путь к Unix-сокету")
+		}
+		if _, err := l.socketMode(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("неподдерживаемый тип сети %q (ожидается tcp, tcp4, tcp6 или unix)", l.Network)
+	}
+	return nil
+}
+
+// socketMode разбирает права на Unix-сокет; 0 означает «не менять»
+func (l ListenerConfig) socketMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("некорректные права socketMode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
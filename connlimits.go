@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+// Поведение при превышении maxConnections/maxSourceIPs (users.onLimit)
+const (
+	limitRejectNewest = "reject-newest"
+	limitEvictOldest  = "evict-oldest"
+)
+
+var (
+	errTooManyConnections = errors.New("превышено число одновременных соединений пользователя")
+	errTooManySourceIPs   = errors.New("превышено число адресов, с которых работает пользователь")
+)
+
+// UserConnections - активные соединения пользователя для статистики
+type UserConnections struct {
+	ActiveConnections int   `json:"activeConnections"`
+	SourceIPs         int   `json:"sourceIPs"`
+	Rejected          int64 `json:"rejected"` // Отклонено соединений сверх ограничений с момента запуска
+	Evicted           int64 `json:"evicted"`  // Закрыто старых соединений ради новых с момента запуска
+}
+
+// userLimitCounters - счётчики отклонённых и вытесненных соединений, защищены sessionsMutex
+var userLimitCounters = make(map[string]*UserConnections)
+
+// admitSession проверяет ограничения maxConnections и maxSourceIPs пользователя
+// и допускает сессию. При политике evict-oldest вместо отказа закрываются самые
+// старые сессии пользователя (для maxSourceIPs - все сессии самого старого адреса).
+func admitSession(sess *session) error {
+	usersMutex.RLock()
+	user := users[sess.username]
+	usersMutex.RUnlock()
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if user.MaxConnections <= 0 && user.MaxSourceIPs <= 0 {
+		sess.admitted = true
+		return nil
+	}
+	counters := userLimitCountersLocked(sess.username)
+	evict := config.Users.OnLimit == limitEvictOldest
+
+	active := userSessionsLocked(sess.username)
+	if user.MaxSourceIPs > 0 {
+		ips := sessionsByIP(active)
+		if _, known := ips[sess.clientIP]; !known && len(ips) >= user.MaxSourceIPs {
+			if !evict {
+				counters.Rejected++
+				return errTooManySourceIPs
+			}
+			// Освобождаем место, закрывая адреса с самыми старыми сессиями
+			for _, ip := range ipsByAge(ips)[:len(ips)-user.MaxSourceIPs+1] {
+				for _, s := range ips[ip] {
+					evictSessionLocked(s, counters)
+				}
+			}
+			active = userSessionsLocked(sess.username)
+		}
+	}
+	if user.MaxConnections > 0 && len(active) >= user.MaxConnections {
+		if !evict {
+			counters.Rejected++
+			return errTooManyConnections
+		}
+		for _, s := range active[:len(active)-user.MaxConnections+1] {
+			evictSessionLocked(s, counters)
+		}
+	}
+
+	sess.admitted = true
+	return nil
+}
+
+// userSessionsLocked возвращает допущенные сессии пользователя от старых к новым.
+// Вызывается под sessionsMutex.
+func userSessionsLocked(username string) []*session {
+	var list []*session
+	for s := range sessions {
+		if s.admitted && s.username == username {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	return list
+}
+
+// sessionsByIP группирует сессии по адресу клиента
+func sessionsByIP(list []*session) map[string][]*session {
+	ips := make(map[string][]*session)
+	for _, s := range list {
+		ips[s.clientIP] = append(ips[s.clientIP], s)
+	}
+	return ips
+}
+
+// ipsByAge упорядочивает адреса по времени их самой старой сессии
+func ipsByAge(ips map[string][]*session) []string {
+	list := make([]string, 0, len(ips))
+	for ip := range ips {
+		list = append(list, ip)
+	}
+	// Сессии каждого адреса уже упорядочены от старых к новым
+	sort.Slice(list, func(i, j int) bool { return ips[list[i]][0].started.Before(ips[list[j]][0].started) })
+	return list
+}
+
+// evictSessionLocked закрывает сессию, уступающую место новой. Вызывается под sessionsMutex.
+func evictSessionLocked(s *session, counters *UserConnections) {
+	log.Printf("Закрыта старая сессия пользователя %s с %s ради нового соединения (ограничение соединений)", s.username, s.clientIP)
+	s.admitted = false
+	s.closeLocked()
+	counters.Evicted++
+}
+
+// userLimitCountersLocked возвращает счётчики пользователя, создавая их при необходимости.
+// Вызывается под sessionsMutex.
+func userLimitCountersLocked(username string) *UserConnections {
+	c, ok := userLimitCounters[username]
+	if !ok {
+		c = &UserConnections{}
+		userLimitCounters[username] = c
+	}
+	return c
+}
+
+// userConnectionStats возвращает число активных соединений и адресов каждого пользователя
+func userConnectionStats() map[string]*UserConnections {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	result := make(map[string]*UserConnections)
+	ips := make(map[string]map[string]bool)
+	for s := range sessions {
+		if !s.admitted || s.username == "" {
+			continue
+		}
+		stats, ok := result[s.username]
+		if !ok {
+			stats = &UserConnections{}
+			result[s.username] = stats
+			ips[s.username] = make(map[string]bool)
+		}
+		stats.ActiveConnections++
+		ips[s.username][s.clientIP] = true
+	}
+	for username, c := range userLimitCounters {
+		stats, ok := result[username]
+		if !ok {
+			stats = &UserConnections{}
+			result[username] = stats
+		}
+		stats.Rejected, stats.Evicted = c.Rejected, c.Evicted
+	}
+	for username, stats := range result {
+		stats.SourceIPs = len(ips[username])
+	}
+	return result
+}
@@ -6,6 +6,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     const summaryCardsContainer = document.getElementById('summary-cards');
     const userStatsTableBody = document.querySelector('#user-stats-table tbody');
+    const listenerStatsTableBody = document.querySelector('#listener-stats-table tbody');
     const chartCanvas = document.getElementById('traffic-chart').getContext('2d');
 
     // --- Инициализация карты ---
@@ -27,6 +28,36 @@ document.addEventListener('DOMContentLoaded', () => {
         return parseFloat((bytes / Math.pow(k, i)).toFixed(dm)) + ' ' + sizes[i];
     }
 
+    // Функция для форматирования даты начала отсчёта
+    function formatSince(since) {
+        const date = since ? new Date(since) : null;
+        if (!date || isNaN(date) || date.getFullYear() < 2000) return '—';
+        return date.toLocaleString('ru-RU');
+    }
+
+    // Функция для описания неудачных входов и блокировок
+    function formatAuthFailures(failures) {
+        if (!failures) return '0';
+        const banned = (failures.bannedIPs || []).length;
+        const locked = (failures.lockedUsers || []).length;
+        return `${failures.total} (блокировано адресов: ${banned}, учётных записей: ${locked})`;
+    }
+
+    // Функция для описания таймаутов по причинам
+    function formatTimeouts(timeouts) {
+        const entries = Object.entries(timeouts || {});
+        if (entries.length === 0) return '0';
+        const total = entries.reduce((sum, [, n]) => sum + n, 0);
+        return `${total} (${entries.map(([kind, n]) => `${kind}: ${n}`).join(', ')})`;
+    }
+
+    // Функция для описания отказов в приёме соединений
+    function formatAcceptLimits(limits) {
+        if (!limits) return '0';
+        const rejected = Object.values(limits.rejected || {}).reduce((sum, n) => sum + n, 0);
+        return `${rejected} (в очереди было: ${limits.queued}, рукопожатий сейчас: ${limits.pendingHandshakes})`;
+    }
+
     // Функция для обновления карточек
     function updateSummaryCards(stats) {
         summaryCardsContainer.innerHTML = `
@@ -42,14 +73,70 @@ document.addEventListener('DOMContentLoaded', () => {
                 <h3>Всего скачано (Download)</h3>
                 <div class="value">${formatBytes(stats.totalDownloadBytes || 0)}</div>
             </div>
+            <div class="card">
+                <h3>Счётчики с</h3>
+                <div class="value">${formatSince(stats.countersSince)}</div>
+            </div>
+            <div class="card">
+                <h3>Неудачные входы</h3>
+                <div class="value">${formatAuthFailures(stats.authFailures)}</div>
+            </div>
+            <div class="card">
+                <h3>Таймауты</h3>
+                <div class="value">${formatTimeouts(stats.timeouts)}</div>
+            </div>
+            <div class="card">
+                <h3>Отклонённые соединения</h3>
+                <div class="value">${formatAcceptLimits(stats.acceptLimits)}</div>
+            </div>
         `;
     }
 
+    // Функция для описания ограничения скорости пользователя
+    function formatThrottle(throttle) {
+        if (!throttle) return '—';
+        const parts = [];
+        if (throttle.uploadLimit) parts.push(`↑ ${formatBytes(throttle.uploadLimit)}/s`);
+        if (throttle.downloadLimit) parts.push(`↓ ${formatBytes(throttle.downloadLimit)}/s`);
+        let text = parts.join(' ') || '—';
+        if (throttle.throttled) text += ' <span class="throttled">ограничивается</span>';
+        return text;
+    }
+
+    // Функция для описания расхода квоты пользователя
+    function formatQuota(quota) {
+        if (!quota) return '—';
+        const until = new Date(quota.periodEnd).toLocaleDateString('ru-RU');
+        let text = `${formatBytes(quota.usedBytes)} из ${formatBytes(quota.limitBytes)}, осталось ${formatBytes(quota.remainingBytes)} (до ${until})`;
+        if (quota.exceeded) text += ' <span class="throttled">исчерпана</span>';
+        return text;
+    }
+
+    // Функция для пометки учётной записи с ограниченным сроком или расписанием
+    function formatAccountStatus(account) {
+        if (!account || account.status === 'active') return '';
+        const labels = {
+            pending: 'ещё не действует',
+            expired: 'срок истёк',
+            'off-schedule': 'вне расписания',
+            disabled: 'отключён',
+        };
+        return ` <span class="throttled">${labels[account.status] || account.status}</span>`;
+    }
+
+    // Функция для описания активных соединений пользователя
+    function formatConnections(conns) {
+        if (!conns) return '0';
+        let text = `${conns.activeConnections} (адресов: ${conns.sourceIPs})`;
+        if (conns.rejected || conns.evicted) text += `, отклонено ${conns.rejected}, вытеснено ${conns.evicted}`;
+        return text;
+    }
+
     // Функция для обновления таблицы пользователей
-    function updateUserStatsTable(userStats) {
+    function updateUserStatsTable(userStats, userThrottle, quotaUsage, userConnections, accountStatus) {
         userStatsTableBody.innerHTML = ''; // Очищаем таблицу
         if (!userStats) {
-            userStatsTableBody.innerHTML = '<tr><td colspan="3">Нет данных о пользователях.</td></tr>';
+            userStatsTableBody.innerHTML = '<tr><td colspan="6">Нет данных о пользователях.</td></tr>';
             return;
         }
 
@@ -59,14 +146,41 @@ document.addEventListener('DOMContentLoaded', () => {
             const stats = userStats[username];
             const row = document.createElement('tr');
             row.innerHTML = `
-                <td>${username}</td>
+                <td>${username}${formatAccountStatus((accountStatus || {})[username])}</td>
+                <td>${formatConnections((userConnections || {})[username])}</td>
                 <td>${formatBytes(stats.uploadBytes)}</td>
                 <td>${formatBytes(stats.downloadBytes)}</td>
+                <td>${formatThrottle((userThrottle || {})[username])}</td>
+                <td>${formatQuota((quotaUsage || {})[username])}</td>
             `;
             userStatsTableBody.appendChild(row);
         }
     }
 
+    // Функция для обновления таблицы точек входа
+    function updateListenerStatsTable(listenerStats) {
+        listenerStatsTableBody.innerHTML = ''; // Очищаем таблицу
+        if (!listenerStats) {
+            listenerStatsTableBody.innerHTML = '<tr><td colspan="5">Нет данных о точках входа.</td></tr>';
+            return;
+        }
+
+        const sortedListeners = Object.keys(listenerStats).sort();
+
+        for (const name of sortedListeners) {
+            const stats = listenerStats[name];
+            const row = document.createElement('tr');
+            row.innerHTML = `
+                <td>${name}</td>
+                <td>${stats.activeConnections}</td>
+                <td>${stats.connections}</td>
+                <td>${formatBytes(stats.uploadBytes)}</td>
+                <td>${formatBytes(stats.downloadBytes)}</td>
+            `;
+            listenerStatsTableBody.appendChild(row);
+        }
+    }
+
     // Функция для создания/обновления графика
     function updateChart(userStats) {
         if (!userStats) return;
@@ -187,7 +301,8 @@ document.addEventListener('DOMContentLoaded', () => {
             const stats = await response.json();
 
             updateSummaryCards(stats);
-            updateUserStatsTable(stats.userStats);
+            updateUserStatsTable(stats.userStats, stats.userThrottle, stats.quotaUsage, stats.userConnections, stats.accountStatus);
+            updateListenerStatsTable(stats.listenerStats);
             updateChart(stats.userStats);
             updateMap(stats.countryStats); // Обновляем карту
 
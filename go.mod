@@ -2,9 +2,13 @@ module The-ASTRACAT-SOCKS-Eliza
 
 go 1.24.3
 
-require github.com/oschwald/geoip2-golang v1.13.0
+require (
+	github.com/oschwald/geoip2-golang v1.13.0
+	golang.org/x/crypto v0.45.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/oschwald/maxminddb-golang v1.13.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
 )
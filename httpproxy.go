@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	httpProxyRealm       = "The-ASTRACAT-SOCKS-Eliza"
+	httpMaxAuthAttempts  = 3 // Сколько запросов без верных учётных данных допускается на одном соединении
+	httpDefaultPort      = "80"
+	httpConnectEstablish = "HTTP/1.1 200 Connection established\r\n\r\n"
+
+	// httpMaxHeaderBytes ограничивает строку запроса и заголовки, как http.DefaultMaxHeaderBytes;
+	// запас на буфер чтения добавляется так же, как в net/http
+	httpMaxHeaderBytes = 1<<20 + 4096
+)
+
+// errHeaderTooLarge возвращается, когда заголовок запроса превысил httpMaxHeaderBytes
+var errHeaderTooLarge = errors.New("заголовок HTTP-запроса слишком большой")
+
+// headerLimitReader ограничивает объём данных, прочитанных из соединения, пока
+// разбирается заголовок запроса. Тело запроса и туннель читаются без ограничения.
+type headerLimitReader struct {
+	r         io.Reader
+	remaining int64 // Сколько ещё можно прочитать; < 0 - без ограничения
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return l.r.Read(p)
+	}
+	if l.remaining == 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// hopByHopHeaders не передаются целевому серверу (RFC 7230, раздел 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders удаляет заголовки, относящиеся к одному соединению:
+// стандартные и перечисленные в Connection
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, h := range hopByHopHeaders {
+		header.Del(h)
+	}
+}
+
+// looksLikeHTTP сообщает, может ли байт быть началом строки HTTP-запроса (имя метода)
+func looksLikeHTTP(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// handleHTTPProxy обслуживает HTTP-прокси: туннель CONNECT или пересылку запроса
+// с абсолютным URI. Аутентификация - Proxy-Authorization: Basic по таблице users.
+func handleHTTPProxy(conn *peekConn, sess *session) error {
+	// Все дальнейшие чтения из соединения, включая туннель, идут через ограничитель
+	limit := &headerLimitReader{r: conn.r, remaining: -1}
+	conn.r = bufio.NewReader(limit)
+
+	var req *http.Request
+	var username string
+	for attempt := 0; ; attempt++ {
+		var err error
+		limit.remaining = httpMaxHeaderBytes
+		req, err = http.ReadRequest(conn.r)
+		limit.remaining = -1
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if errors.Is(err, errHeaderTooLarge) {
+				writeHTTPError(conn, http.StatusRequestHeaderFieldsTooLarge, nil)
+				return fmt.Errorf("HTTP-прокси: заголовок запроса от %s больше %d байт", conn.RemoteAddr(), httpMaxHeaderBytes)
+			}
+			writeHTTPError(conn, http.StatusBadRequest, nil)
+			return fmt.Errorf("ошибка чтения HTTP-запроса: %w", err)
+		}
+		req.RemoteAddr = conn.RemoteAddr().String()
+
+		var ok bool
+		username, ok = httpProxyUsername(req, sess.clientIP, sess.listener.auth)
+		if ok {
+			break
+		}
+
+		// Тело отклонённого запроса нужно дочитать, чтобы клиент мог повторить запрос на том же соединении
+		_, _ = io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		header := http.Header{}
+		header.Set("Proxy-Authenticate", `Basic realm="`+httpProxyRealm+`"`)
+		writeHTTPError(conn, http.StatusProxyAuthRequired, header)
+		if attempt+1 >= httpMaxAuthAttempts || req.Close {
+			return fmt.Errorf("HTTP-прокси: нет верных учётных данных от %s", conn.RemoteAddr())
+		}
+	}
+	log.Printf("HTTP-прокси: аутентификация успешна для пользователя: %s (с %s)", username, conn.RemoteAddr())
+	sess.setUsername(username)
+	sess.finishHandshake()
+
+	if err := checkUserAccess(sess); err != nil {
+		writeHTTPError(conn, http.StatusForbidden, nil)
+		return err
+	}
+
+	if req.Method == http.MethodConnect {
+		return handleHTTPConnect(conn, req, sess)
+	}
+	return handleHTTPForward(conn, req, sess)
+}
+
+// httpProxyUsername определяет пользователя по заголовку Proxy-Authorization.
+// Клиентам из сетей без аутентификации заголовок не нужен.
+func httpProxyUsername(req *http.Request, clientIP string, policy *authPolicy) (string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		if policy.allowsNoAuth(clientIP) {
+			return policy.noAuthUser, true
+		}
+		return "", false
+	}
+
+	scheme, encoded, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return "", false
+	}
+	if err := checkLogin(clientIP, username, password); err != nil {
+		log.Printf("HTTP-прокси: аутентификация не удалась для пользователя: %s (с %s): %v", username, req.RemoteAddr, err)
+		return "", false
+	}
+	return username, true
+}
+
+// handleHTTPConnect устанавливает туннель по методу CONNECT
+func handleHTTPConnect(conn *peekConn, req *http.Request, sess *session) error {
+	target := req.Host
+	host, port, err := splitTarget(target)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("HTTP CONNECT: некорректный адрес %q", target)
+	}
+
+	targetConn, err := dialDestination(sess, host, port)
+	if err != nil {
+		log.Printf("Ошибка Dial к %s (запрошено %s от %s по HTTP CONNECT): %v", target, sess.username, conn.RemoteAddr(), err)
+		writeHTTPError(conn, dialErrorStatus(err), nil)
+		return fmt.Errorf("не удалось подключиться к целевому хосту: %w", err)
+	}
+	defer targetConn.Close()
+
+	if _, err := io.WriteString(conn, httpConnectEstablish); err != nil {
+		return fmt.Errorf("ошибка отправки ответа на CONNECT: %w", err)
+	}
+	return proxyData(sess, conn, targetConn)
+}
+
+// handleHTTPForward пересылает запрос с абсолютным URI целевому серверу. Запрос
+// и ответ передаются с Connection: close, а данные клиента после первого запроса
+// серверу не пересылаются: каждый запрос проходит проверку доступа на своём соединении.
+func handleHTTPForward(conn *peekConn, req *http.Request, sess *session) error {
+	defer req.Body.Close()
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("HTTP-прокси: ожидался абсолютный URI http://, получен %q", req.RequestURI)
+	}
+
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), httpDefaultPort)
+	}
+	host, port, err := splitTarget(target)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("HTTP-прокси: некорректный адрес %q", target)
+	}
+
+	targetConn, err := dialDestination(sess, host, port)
+	if err != nil {
+		log.Printf("Ошибка Dial к %s (запрошено %s от %s по HTTP): %v", target, sess.username, conn.RemoteAddr(), err)
+		writeHTTPError(conn, dialErrorStatus(err), nil)
+		return fmt.Errorf("не удалось подключиться к целевому хосту: %w", err)
+	}
+	defer targetConn.Close()
+
+	removeHopByHopHeaders(req.Header)
+	req.Close = true
+
+	sess.addPeer(targetConn)
+	sess.startRelay()
+	defer sess.flushTraffic()
+
+	uploadLimits, downloadLimits := sessionLimiters(sess)
+	requestWriter := &customWriter{Writer: targetConn, counter: &sess.pendingUpload, limits: uploadLimits, closed: sess.closed}
+	if err := req.Write(requestWriter); err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, nil)
+		return fmt.Errorf("ошибка отправки запроса целевому серверу: %w", err)
+	}
+
+	responseWriter := &customWriter{Writer: conn, counter: &sess.pendingDownload, limits: downloadLimits, closed: sess.closed}
+	resp, err := readHTTPResponse(bufio.NewReader(targetConn), req, responseWriter)
+	if err != nil {
+		if reason := sess.closedBy(); reason != "" {
+			return fmt.Errorf("сессия закрыта: %s", reason)
+		}
+		writeHTTPError(conn, http.StatusBadGateway, nil)
+		return fmt.Errorf("ошибка чтения ответа целевого сервера: %w", err)
+	}
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	resp.Close = true
+
+	if err := resp.Write(responseWriter); err != nil {
+		if reason := sess.closedBy(); reason != "" {
+			return fmt.Errorf("сессия закрыта: %s", reason)
+		}
+		return fmt.Errorf("ошибка пересылки ответа клиенту: %w", err)
+	}
+	return nil
+}
+
+// readHTTPResponse читает ответ на запрос req. Промежуточные ответы 1xx пересылаются
+// клиенту как есть, возвращается окончательный ответ.
+func readHTTPResponse(r *bufio.Reader, req *http.Request, client io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode > 199 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if err := resp.Write(client); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dialErrorStatus подбирает HTTP-статус по ошибке установки соединения
+func dialErrorStatus(err error) int {
+	switch dialErrorReply(err) {
+	case replyTTLExpired:
+		return http.StatusGatewayTimeout
+	case replyNotAllowed:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// splitTarget разбирает адрес хост:порт из запроса
+func splitTarget(target string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("некорректный порт %q", portStr)
+	}
+	return host, port, nil
+}
+
+// writeHTTPError отправляет клиенту короткий ответ с кодом status
+func writeHTTPError(conn net.Conn, status int, header http.Header) {
+	body := http.StatusText(status) + "\n"
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	for k, v := range header {
+		resp.Header[k] = v
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	_ = resp.Write(conn)
+}
@@ -62,7 +62,7 @@ go mod tidy
 
 # Сборка прокси-сервера
 echo "[+] Сборка прокси-сервера..."
-go build -o astra_socks_eliza main.go
+go build -o astra_socks_eliza .
 if [ $? -ne 0 ]; then
     echo "[-] Ошибка при сборке прокси-сервера."
     exit 1
@@ -89,6 +89,10 @@ Description=The-ASTRACAT-SOCKS-Eliza Proxy Server
 After=network.target
 
 [Service]
+# notify: при обновлении по SIGUSR2 новый процесс сообщает свой PID, и systemd не
+# останавливает его, когда завершается старый. TimeoutStopSec больше shutdown.drainTimeout.
+Type=notify
+NotifyAccess=all
 User=$USER
 Group=$USER
 WorkingDirectory=$PROJECT_DIR
@@ -96,6 +100,7 @@ ExecStart=$PROJECT_DIR/astra_socks_eliza
 StandardOutput=null
 StandardError=journal
 Restart=always
+TimeoutStopSec=45
 
 [Install]
 WantedBy=multi-user.target
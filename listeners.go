@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// forceCloseGrace - сколько ждать обработчики после принудительного закрытия сессий
+const forceCloseGrace = 5 * time.Second
+
+// proxyListener - запущенная точка входа со своей политикой аутентификации
+type proxyListener struct {
+	name        string
+	network     string
+	address     string
+	bindAddress string // Адрес из конфигурации, по нему сокет узнаётся при обновлении
+	auth        *authPolicy
+	acl         []ACLRule // Правила доступа точки входа (listeners[].acl)
+	listener    net.Listener
+}
+
+// startListeners открывает все точки входа. Слушатели, унаследованные от предыдущего
+// процесса (inherited), используются повторно, если адрес точки входа не изменился.
+// При ошибке уже открытые закрываются.
+func startListeners(configs []ListenerConfig, inherited map[string]net.Listener) ([]*proxyListener, error) {
+	var started []*proxyListener
+	for _, lc := range configs {
+		key := upgradeKey(lc.Name, lc.Network, lc.Address)
+		ln := inherited[key]
+		delete(inherited, key)
+		l, err := openListener(lc, ln)
+		if err != nil {
+			for _, s := range started {
+				s.listener.Close()
+			}
+			return nil, fmt.Errorf("слушатель %s (%s %s): %w", lc.Name, lc.Network, lc.Address, err)
+		}
+		started = append(started, l)
+	}
+	// Точки входа, которых больше нет в конфигурации
+	for key, ln := range inherited {
+		log.Printf("Унаследованный слушатель %s не используется в новой конфигурации, закрываем", key)
+		ln.Close()
+	}
+	return started, nil
+}
+
+// openListener создаёт слушатель по его конфигурации или использует унаследованный ln
+func openListener(lc ListenerConfig, ln net.Listener) (*proxyListener, error) {
+	policy, err := newAuthPolicy(config.listenerAuth(lc))
+	if err != nil {
+		return nil, err
+	}
+
+	if ln != nil {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true) // Файл сокета теперь принадлежит этому процессу
+		}
+		return &proxyListener{
+			name:        lc.Name,
+			network:     lc.Network,
+			address:     ln.Addr().String(),
+			bindAddress: lc.Address,
+			auth:        policy,
+			acl:         lc.ACL,
+			listener:    ln,
+		}, nil
+	}
+
+	if lc.Network == "unix" {
+		// Удаляем сокет, оставшийся от предыдущего запуска
+		if err := os.Remove(lc.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("не удалось удалить старый Unix-сокет: %w", err)
+		}
+	}
+
+	ln, err = net.Listen(lc.Network, lc.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.Network == "unix" {
+		mode, _ := lc.socketMode()
+		if mode != 0 {
+			if err := os.Chmod(lc.Address, mode); err != nil {
+				ln.Close()
+				return nil, fmt.Errorf("не удалось установить права на Unix-сокет: %w", err)
+			}
+		}
+	}
+
+	return &proxyListener{
+		name:        lc.Name,
+		network:     lc.Network,
+		address:     ln.Addr().String(),
+		bindAddress: lc.Address,
+		auth:        policy,
+		acl:         lc.ACL,
+		listener:    ln,
+	}, nil
+}
+
+// serve принимает соединения и обрабатывает каждое в отдельной горутине
+func (l *proxyListener) serve() {
+	defer l.listener.Close()
+	log.Printf("SOCKS5 сервер The-ASTRACAT-SOCKS-Eliza запущен на %s (%s, слушатель %s)%s", l.address, l.network, l.name, l.auth.describe())
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return // Слушатель закрыт при остановке сервера
+			}
+			log.Printf("Ошибка при приёме соединения на %s: %v", l.name, err)
+			continue
+		}
+		if rejectBannedConn(conn) {
+			continue
+		}
+		adm, ok := admitConn(conn)
+		if !ok {
+			continue
+		}
+		// Соединение могло ждать места в acquireSlot, пока сервер начал останавливаться
+		if !startSession() {
+			adm.release()
+			conn.Close()
+			return
+		}
+		activeConnectionsMutex.Lock()
+		activeConnectionsCounter++
+		activeConnectionsMutex.Unlock()
+
+		go func() {
+			defer sessionsWG.Done()
+			defer adm.release()
+			handleConnection(conn, l, adm)
+		}()
+	}
+}
+
+// shutdown останавливает сервер: закрывает слушатели, ждёт завершения активных
+// сессий не дольше shutdown.drainTimeout, закрывает оставшиеся и сохраняет статистику.
+// Повторный SIGTERM/SIGINT в stop прерывает ожидание. При обновлении (control != nil)
+// слушатели уже обслуживает новый процесс, и статистика передаётся ему.
+func shutdown(listeners []*proxyListener, stop <-chan os.Signal, control net.Conn) {
+	if control != nil {
+		handOffListeners(listeners)
+		if err := sendStatsDelta(control); err != nil {
+			log.Printf("Обновление: не удалось передать статистику новому процессу: %v", err)
+		}
+	} else {
+		sdNotify("STOPPING=1")
+		for _, l := range listeners {
+			l.listener.Close()
+		}
+	}
+	stopAccepting()
+
+	activeConnectionsMutex.Lock()
+	active := activeConnectionsCounter
+	activeConnectionsMutex.Unlock()
+	if active > 0 {
+		log.Printf("Приём соединений остановлен, ожидание завершения активных сессий (%d) до %s", active, config.Shutdown.DrainTimeout)
+	}
+
+	drained := make(chan bool, 1)
+	go func() { drained <- waitSessions(config.Shutdown.DrainTimeout) }()
+wait:
+	for {
+		select {
+		case ok := <-drained:
+			if !ok {
+				n := closeAllSessions()
+				log.Printf("Время ожидания истекло, принудительно закрыто сессий: %d", n)
+			}
+			break wait
+		case sig := <-stop:
+			if sig == syscall.SIGUSR1 || sig == syscall.SIGUSR2 {
+				log.Printf("Сервер останавливается, сигнал %v пропущен", sig)
+				continue
+			}
+			n := closeAllSessions()
+			log.Printf("Повторный сигнал %v, принудительно закрыто сессий: %d", sig, n)
+			break wait
+		}
+	}
+
+	// После закрытия соединений обработчики быстро завершаются и учитывают трафик
+	if !waitSessions(forceCloseGrace) {
+		log.Printf("Внимание: не все обработчики завершились за %s", forceCloseGrace)
+	}
+
+	if control != nil {
+		if err := sendStatsDelta(control); err != nil {
+			log.Printf("Обновление: не удалось передать статистику новому процессу: %v", err)
+		}
+		control.Close()
+		log.Println("Статистика передана новому процессу, старый процесс остановлен.")
+		return
+	}
+	saveStats()
+	log.Println("Статистика сохранена, сервер остановлен.")
+}
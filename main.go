@@ -2,14 +2,18 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/oschwald/geoip2-golang"
@@ -19,15 +23,23 @@ const (
 	socks5Version        = 0x05
 	noAuthRequired       = 0x00
 	usernamePasswordAuth = 0x02
+	noAcceptableMethods  = 0xFF
 	connectCommand       = 0x01
+	bindCommand          = 0x02
+	udpAssociateCommand  = 0x03
 	ipv4Address          = 0x01
 	domainNameAddress    = 0x03
 	ipv6Address          = 0x04
 	replySuccess         = 0x00
 
-	statsFilePath    = "/var/lib/astra_socks_eliza/stats.json" // Путь к файлу статистики
-	usersFilePath    = "/etc/astra_socks_eliza/users.json"     // Путь к файлу пользователей
-	geoIPDBPath      = "/usr/share/GeoIP/GeoLite2-Country.mmdb" // Путь к GeoIP базе данных
+	replyGeneralFailure          = 0x01
+	replyNotAllowed              = 0x02
+	replyNetworkUnreachable      = 0x03
+	replyHostUnreachable         = 0x04
+	replyConnectionRefused       = 0x05
+	replyTTLExpired              = 0x06
+	replyCommandNotSupported     = 0x07
+	replyAddressTypeNotSupported = 0x08
 )
 
 // --- Структуры данных для пользователей и статистики (в памяти) ---
@@ -35,8 +47,25 @@ const (
 // User представляет пользователя SOCKS5
 type User struct {
 	Username string `json:"username"`
-	Password string `json:"password"` // В реальной жизни хешировать!
+	Password string `json:"password"` // Хеш argon2id/bcrypt (PHC) или, устаревший вариант, открытый текст
 	Enabled  bool   `json:"enabled"`
+
+	RateLimit RateLimit `json:"rateLimit,omitzero"` // Ограничения скорости пользователя, байт/с
+	Quota     Quota     `json:"quota,omitzero"`     // Квота трафика на расчётный период
+
+	MaxConnections int `json:"maxConnections,omitempty"` // Одновременных соединений; 0 - без ограничения
+	MaxSourceIPs   int `json:"maxSourceIPs,omitempty"`   // Адресов, с которых одновременно работает пользователь; 0 - без ограничения
+
+	ValidFrom time.Time `json:"validFrom,omitzero"` // Начало срока действия учётной записи
+	ExpiresAt time.Time `json:"expiresAt,omitzero"` // Окончание срока действия учётной записи
+	Schedule  *Schedule `json:"schedule,omitempty"` // Разрешённые часы работы
+
+	ACL          []ACLRule `json:"acl,omitempty"`          // Правила доступа к адресам назначения; проверяются раньше общих
+	AllowPrivate []string  `json:"allowPrivate,omitempty"` // Внутренние сети, доступные пользователю несмотря на protectedNetworks
+
+	SOCKS4 bool `json:"socks4,omitempty"` // Разрешить вход по SOCKS4: только по USERID, пароль не проверяется
+
+	allowPrivate []*net.IPNet // Разобранные сети AllowPrivate
 }
 
 // UserTraffic представляет статистику трафика для пользователя
@@ -52,98 +81,192 @@ type CountryStats struct {
 	Connections   int64 `json:"connections"`
 }
 
+// ListenerStats представляет статистику по точке входа (слушателю)
+type ListenerStats struct {
+	UploadBytes       int64 `json:"uploadBytes"`
+	DownloadBytes     int64 `json:"downloadBytes"`
+	Connections       int64 `json:"connections"`
+	ActiveConnections int64 `json:"activeConnections"`
+}
+
 // GlobalStats представляет общую статистику
 type GlobalStats struct {
-	TotalUploadBytes   int64                    `json:"totalUploadBytes"`
-	TotalDownloadBytes int64                    `json:"totalDownloadBytes"`
-	ActiveConnections  int32                    `json:"activeConnections"`
-	UserStats          map[string]UserTraffic   `json:"userStats"`          // Статистика по каждому пользователю
-	CountryStats       map[string]*CountryStats `json:"countryStats"`       // Статистика по странам (ключ - код страны)
-	LastUpdateTime     time.Time                `json:"lastUpdateTime"`
+	TotalUploadBytes   int64                       `json:"totalUploadBytes"`
+	TotalDownloadBytes int64                       `json:"totalDownloadBytes"`
+	ActiveConnections  int32                       `json:"activeConnections"`
+	UserStats          map[string]UserTraffic      `json:"userStats"`                // Статистика по каждому пользователю
+	CountryStats       map[string]*CountryStats    `json:"countryStats"`             // Статистика по странам (ключ - код страны)
+	ListenerStats      map[string]*ListenerStats   `json:"listenerStats"`            // Статистика по точкам входа (ключ - имя слушателя)
+	GlobalThrottle     *ThrottleStats              `json:"globalThrottle,omitempty"` // Общее ограничение скорости
+	UserThrottle       map[string]*ThrottleStats   `json:"userThrottle,omitempty"`   // Ограничения скорости пользователей
+	QuotaUsage         map[string]*QuotaUsage      `json:"quotaUsage,omitempty"`     // Расход квот в текущем периоде
+	UserConnections    map[string]*UserConnections `json:"userConnections"`          // Активные соединения и адреса пользователей
+	AccountStatus      map[string]*AccountStatus   `json:"accountStatus,omitempty"`  // Учётные записи с ограниченным сроком или расписанием
+	AuthFailures       *AuthFailureStats           `json:"authFailures"`             // Неудачные входы и блокировки с момента запуска
+	Timeouts           map[string]int64            `json:"timeouts"`                 // Таймауты по причинам с момента запуска
+	AcceptLimits       *AcceptLimitStats           `json:"acceptLimits"`             // Ограничения приёма соединений
+	CountersSince      time.Time                   `json:"countersSince"`            // С какого момента накапливаются счётчики
+	LastUpdateTime     time.Time                   `json:"lastUpdateTime"`
 }
 
 // Глобальные хранилища в памяти
 var (
-	users      = make(map[string]User)      // key: username, value: User
-	usersMutex sync.RWMutex                 // Мьютекс для доступа к users
+	users      = make(map[string]User) // key: username, value: User
+	usersMutex sync.RWMutex            // Мьютекс для доступа к users
 
-	trafficStats = make(map[string]UserTraffic) // key: username, value: UserTraffic
-	countryStats = make(map[string]*CountryStats) // key: country code, value: stats
-	trafficMutex sync.RWMutex                   // Мьютекс для доступа к trafficStats и countryStats
+	trafficStats  = make(map[string]UserTraffic)    // key: username, value: UserTraffic
+	countryStats  = make(map[string]*CountryStats)  // key: country code, value: stats
+	listenerStats = make(map[string]*ListenerStats) // key: listener name, value: stats
+	countersSince = time.Now()                      // Начало отсчёта; восстанавливается из файла статистики
+	trafficMutex  sync.RWMutex                      // Мьютекс для доступа к trafficStats, countryStats, listenerStats и countersSince
 
 	activeConnectionsCounter int32
 	activeConnectionsMutex   sync.Mutex
 
+	statsFileMutex sync.Mutex // Не даёт периодическому и финальному сохранению писать файл одновременно
+
 	geoDB *geoip2.Reader // Указатель на ридер GeoIP базы
 )
 
-// init вызывается один раз при запуске программы
-func init() {
-	// Попытка загрузить пользователей из файла
+// --- SOCKS5 Прокси-сервер ---
+
+func main() {
+	// Служебные подкоманды для работы с паролями
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "hash-password":
+			run = runHashPassword
+		case "migrate-users":
+			run = runMigrateUsers
+		case "unban":
+			run = runUnban
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("Ошибка: %v", err)
+			}
+			return
+		}
+	}
+
+	opts, setFlags, err := parseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, configPath, err := loadConfig(opts, setFlags)
+	if err != nil {
+		log.Fatalf("Критическая ошибка: %v", err)
+	}
+	if opts.checkConfig {
+		if configPath == "" {
+			configPath = "встроенные значения"
+		}
+		fmt.Printf("Конфигурация корректна (%s)\n", configPath)
+		return
+	}
+	config = cfg
+	if configPath != "" {
+		log.Printf("Конфигурация загружена из %s.", configPath)
+	}
+
+	// Без корректного файла пользователей сервер не запускается: подстановка пользователя
+	// по умолчанию открыла бы прокси из-за одной ошибки в файле. При перезагрузке ошибка
+	// оставляет прежний список (см. reloadUsers).
 	if err := loadUsersFromFile(); err != nil {
-		log.Printf("Внимание: Не удалось загрузить пользователей из файла %s: %v. Добавляем тестового пользователя.", usersFilePath, err)
-		// Добавляем тестового пользователя по умолчанию, если файл не найден или пуст
-		users["astranet"] = User{Username: "astranet", Password: "astranet", Enabled: true}
-	} else {
-		log.Printf("Пользователи загружены из %s.", usersFilePath)
+		log.Fatalf("Критическая ошибка: Не удалось загрузить пользователей: %v", err)
 	}
+	log.Printf("Пользователи загружены из %s.", config.UsersFile)
 
 	// Попытка загрузить GeoIP базу данных
-	var err error
-	geoDB, err = geoip2.Open(geoIPDBPath)
+	geoDB, err = geoip2.Open(config.GeoIPDB)
 	if err != nil {
-		log.Printf("Внимание: Не удалось загрузить GeoIP базу данных из %s: %v. Сбор геолокационной статистики будет отключен.", geoIPDBPath, err)
+		log.Printf("Внимание: Не удалось загрузить GeoIP базу данных из %s: %v. Сбор геолокационной статистики будет отключен.", config.GeoIPDB, err)
 	} else {
-		log.Printf("GeoIP база данных успешно загружена из %s.", geoIPDBPath)
+		log.Printf("GeoIP база данных успешно загружена из %s.", config.GeoIPDB)
 	}
 
-	log.Println("Порт SOCKS5: 7777")
-	log.Println("Статистика сохраняется в файл: " + statsFilePath)
-}
-
-// --- SOCKS5 Прокси-сервер ---
+	log.Printf("Порты для BIND: %s, ожидание входящего соединения: %s", bindPortRangeString(), config.Bind.AcceptTimeout)
+	log.Println("Статистика сохраняется в файл: " + config.StatsFile)
 
-func main() {
 	// Создаем необходимые директории для файлов статистики и пользователей, если их нет
-	err := os.MkdirAll(filepath.Dir(statsFilePath), 0755)
+	err = os.MkdirAll(filepath.Dir(config.StatsFile), 0755)
 	if err != nil {
-		log.Fatalf("Критическая ошибка: Не удалось создать директорию для файла статистики (%s): %v", filepath.Dir(statsFilePath), err)
+		log.Fatalf("Критическая ошибка: Не удалось создать директорию для файла статистики (%s): %v", filepath.Dir(config.StatsFile), err)
 	}
-	err = os.MkdirAll(filepath.Dir(usersFilePath), 0755)
+	err = os.MkdirAll(filepath.Dir(config.UsersFile), 0755)
 	if err != nil {
-		log.Fatalf("Критическая ошибка: Не удалось создать директорию для файла пользователей (%s): %v", filepath.Dir(usersFilePath), err)
+		log.Fatalf("Критическая ошибка: Не удалось создать директорию для файла пользователей (%s): %v", filepath.Dir(config.UsersFile), err)
 	}
 
-	go startSocks5Server()
-	go saveStatsPeriodically(5 * time.Second) // Сохраняем статистику каждые 5 секунд
-
-	// Основная горутина просто ждет, чтобы программа не завершилась
-	select {}
-}
+	// При обновлении бинарника слушатели и статистика приходят от предыдущего процесса
+	inherited, upgradeControl, err := inheritedListeners()
+	if err != nil {
+		log.Fatalf("Критическая ошибка: %v", err)
+	}
+	if upgradeControl == nil {
+		if err := restoreStats(); err != nil {
+			log.Printf("Внимание: не удалось восстановить статистику из %s: %v. Счётчики начинаются с нуля.", config.StatsFile, err)
+		}
+	}
+	if config.BruteForce.Enabled {
+		if err := os.MkdirAll(filepath.Dir(config.BruteForce.BanFile), 0755); err != nil {
+			log.Fatalf("Критическая ошибка: Не удалось создать директорию для файла блокировок (%s): %v", filepath.Dir(config.BruteForce.BanFile), err)
+		}
+		if err := loadBanFile(); err != nil {
+			log.Printf("Внимание: %v. Блокировки начинаются с пустого списка.", err)
+		}
+	}
 
-func startSocks5Server() {
-	listener, err := net.Listen("tcp", "0.0.0.0:7777") // SOCKS5 прокси остаётся на порту 7777
+	initAcceptLimits()
+	listeners, err := startListeners(config.effectiveListeners(), inherited)
 	if err != nil {
 		log.Fatalf("Ошибка при запуске SOCKS5 сервера The-ASTRACAT-SOCKS-Eliza: %v", err)
 	}
-	defer listener.Close()
-	log.Println("SOCKS5 сервер The-ASTRACAT-SOCKS-Eliza запущен на 0.0.0.0:7777 с аутентификацией логин/пароль.")
+	for _, l := range listeners {
+		go l.serve()
+	}
+	if upgradeControl != nil {
+		finishUpgrade(upgradeControl)
+		sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	} else {
+		sdNotify("READY=1")
+	}
+	go flushTrafficPeriodically()
+	go saveStatsPeriodically(config.StatsInterval)
+	go watchUsersFile(config.Users.ReloadInterval)
+	if config.BruteForce.Enabled {
+		go watchBanFile()
+	}
+	if config.Users.TerminateExpired {
+		go watchAccountWindows()
+	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Ошибка при приёме соединения: %v", err)
+	// Основная горутина ждёт сигнала завершения или обновления
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range stop {
+		if sig == syscall.SIGUSR1 {
+			resetStats()
 			continue
 		}
-		activeConnectionsMutex.Lock()
-		activeConnectionsCounter++
-		activeConnectionsMutex.Unlock()
-
-		go handleConnection(conn)
+		if sig == syscall.SIGUSR2 {
+			log.Println("Получен сигнал SIGUSR2: обновление исполняемого файла без остановки")
+			control, err := startUpgrade(listeners)
+			if err != nil {
+				log.Printf("Обновление не удалось, продолжаем работу: %v", err)
+				continue
+			}
+			shutdown(listeners, stop, control)
+			return
+		}
+		log.Printf("Получен сигнал %v: остановка сервера", sig)
+		shutdown(listeners, stop, nil)
+		return
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, l *proxyListener, adm *connAdmission) {
 	defer func() {
 		conn.Close()
 		activeConnectionsMutex.Lock()
@@ -151,37 +274,93 @@ func handleConnection(conn net.Conn) {
 		activeConnectionsMutex.Unlock()
 	}()
 
-	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-	if err != nil {
-		log.Printf("Не удалось получить IP клиента %s: %v", conn.RemoteAddr(), err)
-		clientIP = "unknown" // На всякий случай
+	clientIP := "local" // Клиенты Unix-сокета не имеют IP
+	if conn.RemoteAddr().Network() != "unix" {
+		var err error
+		clientIP, _, err = net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			log.Printf("Не удалось получить IP клиента %s: %v", conn.RemoteAddr(), err)
+			clientIP = "unknown" // На всякий случай
+		}
 	}
 
-	// Обновляем счетчик подключений для страны
-	countryCode := getCountryCode(clientIP)
-	if countryCode != "XX" {
-		trafficMutex.Lock()
-		if stats, ok := countryStats[countryCode]; ok {
+	sess := &session{
+		conn:        conn,
+		clientIP:    clientIP,
+		countryCode: getCountryCode(clientIP),
+		listener:    l,
+		admission:   adm,
+		started:     time.Now(),
+		closed:      make(chan struct{}),
+	}
+	registerSession(sess)
+	defer unregisterSession(sess)
+
+	// Обновляем счетчики подключений для страны и точки входа
+	trafficMutex.Lock()
+	if sess.countryCode != "XX" {
+		if stats, ok := countryStats[sess.countryCode]; ok {
 			stats.Connections++
 		} else {
-			countryStats[countryCode] = &CountryStats{Connections: 1}
+			countryStats[sess.countryCode] = &CountryStats{Connections: 1}
 		}
+	}
+	lStats := listenerStatsFor(l.name)
+	lStats.Connections++
+	lStats.ActiveConnections++
+	trafficMutex.Unlock()
+	defer func() {
+		trafficMutex.Lock()
+		listenerStatsFor(l.name).ActiveConnections--
 		trafficMutex.Unlock()
+	}()
+
+	// До выбора адреса назначения клиент должен уложиться в timeouts.handshake;
+	// обработчики протоколов снимают ограничение перед соединением с целевым хостом
+	setPhaseDeadline(conn, timeoutHandshake)
+
+	// Определяем протокол по первому байту: SOCKS4/4a, HTTP-прокси или SOCKS5
+	pc := newPeekConn(conn)
+	first, err := pc.Peek(1)
+	if err != nil {
+		log.Printf("Ошибка чтения первого байта от %s: %v", conn.RemoteAddr(), phaseTimeout(timeoutHandshake, err))
+		return
+	}
+	if first[0] == socks4Version {
+		if !config.Protocols.SOCKS4 {
+			log.Printf("Отклонено SOCKS4 соединение от %s: SOCKS4 отключён", conn.RemoteAddr())
+			return
+		}
+		if err := handleSocks4(pc, sess); err != nil {
+			log.Printf("Ошибка SOCKS4 запроса для %s: %v", conn.RemoteAddr(), phaseTimeout(timeoutHandshake, err))
+		}
+		return
+	}
+	if looksLikeHTTP(first[0]) {
+		if !config.Protocols.HTTPProxy {
+			log.Printf("Отклонено HTTP соединение от %s: HTTP-прокси отключён", conn.RemoteAddr())
+			return
+		}
+		if err := handleHTTPProxy(pc, sess); err != nil {
+			log.Printf("Ошибка HTTP-прокси для %s: %v", conn.RemoteAddr(), phaseTimeout(timeoutHandshake, err))
+		}
+		return
 	}
 
-	username, err := socks5Handshake(conn)
+	username, err := socks5Handshake(pc, sess.clientIP, l.auth)
 	if err != nil {
-		log.Printf("Ошибка SOCKS5 рукопожатия для %s: %v", conn.RemoteAddr(), err)
+		log.Printf("Ошибка SOCKS5 рукопожатия для %s: %v", conn.RemoteAddr(), phaseTimeout(timeoutHandshake, err))
 		return
 	}
+	sess.setUsername(username)
 
-	if err := handleSocks5Request(conn, username, clientIP); err != nil {
-		log.Printf("Ошибка SOCKS5 запроса для %s (пользователь %s): %v", conn.RemoteAddr(), username, err)
+	if err := handleSocks5Request(pc, sess); err != nil {
+		log.Printf("Ошибка SOCKS5 запроса для %s (пользователь %s): %v", conn.RemoteAddr(), username, phaseTimeout(timeoutHandshake, err))
 		return
 	}
 }
 
-func socks5Handshake(conn net.Conn) (string, error) {
+func socks5Handshake(conn net.Conn, clientIP string, policy *authPolicy) (string, error) {
 	buf := make([]byte, 2)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
@@ -199,32 +378,33 @@ func socks5Handshake(conn net.Conn) (string, error) {
 		return "", fmt.Errorf("ошибка чтения методов аутентификации: %w", err)
 	}
 
-	foundUserPassAuth := false
-	for _, method := range methods {
-		if method == usernamePasswordAuth {
-			foundUserPassAuth = true
-			break
-		}
-	}
-
-	if !foundUserPassAuth {
-		_, _ = conn.Write([]byte{socks5Version, 0xFF})
+	method := policy.selectMethod(methods, clientIP)
+	if method == noAcceptableMethods {
+		_, _ = conn.Write([]byte{socks5Version, noAcceptableMethods})
 		return "", fmt.Errorf("нет поддерживаемых методов аутентификации (требуется 0x02)")
 	}
 
-	_, err = conn.Write([]byte{socks5Version, usernamePasswordAuth})
+	_, err = conn.Write([]byte{socks5Version, method})
 	if err != nil {
 		return "", fmt.Errorf("ошибка отправки подтверждения метода аутентификации: %w", err)
 	}
 
-	username, err := authenticateUserPass(conn)
+	if method == noAuthRequired {
+		log.Printf("Вход без аутентификации как %s (с %s)", policy.noAuthUser, conn.RemoteAddr())
+		return policy.noAuthUser, nil
+	}
+
+	// Логин и пароль ограничены отдельным таймаутом, после них снова действует timeouts.handshake
+	setPhaseDeadline(conn, timeoutAuth)
+	username, err := authenticateUserPass(conn, clientIP)
 	if err != nil {
-		return "", err
+		return "", phaseTimeout(timeoutAuth, err)
 	}
+	setPhaseDeadline(conn, timeoutHandshake)
 	return username, nil
 }
 
-func authenticateUserPass(conn net.Conn) (string, error) {
+func authenticateUserPass(conn net.Conn, clientIP string) (string, error) {
 	buf := make([]byte, 2)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
@@ -254,14 +434,10 @@ func authenticateUserPass(conn net.Conn) (string, error) {
 		return "", fmt.Errorf("ошибка чтения пароля: %w", err)
 	}
 
-	usersMutex.RLock()
-	user, ok := users[username]
-	usersMutex.RUnlock()
-
-	if !ok || !user.Enabled || user.Password != string(password) {
-		log.Printf("Аутентификация не удалась для пользователя: %s (с %s)", username, conn.RemoteAddr())
+	if err := checkLogin(clientIP, username, string(password)); err != nil {
+		log.Printf("Аутентификация не удалась для пользователя: %s (с %s): %v", username, conn.RemoteAddr(), err)
 		_, _ = conn.Write([]byte{0x01, 0x01})
-		return "", fmt.Errorf("неверные имя пользователя или пароль, или пользователь неактивен")
+		return "", err
 	}
 
 	log.Printf("Аутентификация успешна для пользователя: %s (с %s)", username, conn.RemoteAddr())
@@ -272,8 +448,36 @@ func authenticateUserPass(conn net.Conn) (string, error) {
 	return username, nil
 }
 
-func handleSocks5Request(conn net.Conn, username string, clientIP string) error {
-	buf := make([]byte, 4)
+// verifyCredentials проверяет логин и пароль по таблице users, а также срок
+// действия и расписание учётной записи
+func verifyCredentials(username, password string) error {
+	usersMutex.RLock()
+	user, ok := users[username]
+	usersMutex.RUnlock()
+
+	if !ok || !user.Enabled {
+		// Пароль всё равно проверяется, чтобы по времени ответа нельзя было узнать,
+		// существует ли пользователь
+		stored := user.Password
+		if !ok || !isPasswordHash(stored) {
+			stored = dummyPasswordHash()
+		}
+		_, _ = verifyPassword(stored, password)
+		return errInvalidCredentials
+	}
+	match, err := verifyPassword(user.Password, password)
+	if err != nil {
+		log.Printf("Ошибка проверки пароля пользователя %s: %v", username, err)
+		return errInvalidCredentials
+	}
+	if !match {
+		return errInvalidCredentials
+	}
+	return user.accessError(time.Now())
+}
+
+func handleSocks5Request(conn net.Conn, sess *session) error {
+	buf := make([]byte, 3)
 	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return fmt.Errorf("ошибка чтения заголовка запроса SOCKS5: %w", err)
@@ -283,188 +487,326 @@ func handleSocks5Request(conn net.Conn, username string, clientIP string) error
 		return fmt.Errorf("неподдерживаемая версия SOCKS в запросе: %d", buf[0])
 	}
 
-	if buf[1] != connectCommand {
-		_, _ = conn.Write([]byte{socks5Version, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	destAddr, destPort, err := readSocks5Address(conn)
+	if err != nil {
+		if errors.Is(err, errUnsupportedAddressType) {
+			_ = writeSocks5Reply(conn, replyAddressTypeNotSupported, nil)
+		}
+		return err
+	}
+	sess.finishHandshake()
+
+	if err := checkUserAccess(sess); err != nil {
+		_ = writeSocks5Reply(conn, replyNotAllowed, nil)
+		return err
+	}
+
+	switch buf[1] {
+	case connectCommand:
+		return handleConnectCommand(conn, sess, destAddr, destPort)
+	case bindCommand:
+		return handleBindCommand(conn, sess, destAddr, destPort)
+	case udpAssociateCommand:
+		return handleUDPAssociate(conn, sess, destAddr, destPort)
+	default:
+		_ = writeSocks5Reply(conn, replyCommandNotSupported, nil)
 		return fmt.Errorf("неподдерживаемая команда: %d", buf[1])
 	}
+}
+
+// handleConnectCommand устанавливает TCP-соединение с целевым хостом (команда CONNECT)
+func handleConnectCommand(conn net.Conn, sess *session, destAddr string, destPort int) error {
+	target := net.JoinHostPort(destAddr, strconv.Itoa(destPort))
+
+	targetConn, err := dialDestination(sess, destAddr, destPort)
+	if err != nil {
+		rep := dialErrorReply(err)
+		log.Printf("Ошибка Dial к %s (запрошено %s от %s): %v (ответ 0x%02x)", target, sess.username, conn.RemoteAddr(), err, rep)
+		_ = writeSocks5Reply(conn, rep, nil)
+		return fmt.Errorf("не удалось подключиться к целевому хосту: %w", err)
+	}
+	defer targetConn.Close()
+
+	// BND.ADDR/BND.PORT - локальный адрес исходящего соединения
+	err = writeSocks5Reply(conn, replySuccess, targetConn.LocalAddr())
+	if err != nil {
+		return fmt.Errorf("ошибка отправки ответа об успехе: %w", err)
+	}
+
+	return proxyData(sess, conn, targetConn)
+}
+
+// errUnsupportedAddressType возвращается для неизвестного значения ATYP
+var errUnsupportedAddressType = errors.New("неподдерживаемый тип адреса")
+
+// readSocks5Address читает ATYP, DST.ADDR и DST.PORT из запроса SOCKS5
+func readSocks5Address(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", 0, fmt.Errorf("ошибка чтения типа адреса: %w", err)
+	}
 
 	var destAddr string
-	var destPort int
-	switch buf[3] { // ATYP
+	switch atyp[0] {
 	case ipv4Address:
 		ipv4 := make([]byte, 4)
-		_, err = io.ReadFull(conn, ipv4)
+		_, err = io.ReadFull(r, ipv4)
 		if err != nil {
-			return fmt.Errorf("ошибка чтения IPv4 адреса: %w", err)
+			return "", 0, fmt.Errorf("ошибка чтения IPv4 адреса: %w", err)
 		}
 		destAddr = net.IPv4(ipv4[0], ipv4[1], ipv4[2], ipv4[3]).String()
 	case domainNameAddress:
 		lenBuf := make([]byte, 1)
-		_, err = io.ReadFull(conn, lenBuf)
+		_, err = io.ReadFull(r, lenBuf)
 		if err != nil {
-			return fmt.Errorf("ошибка чтения длины доменного имени: %w", err)
+			return "", 0, fmt.Errorf("ошибка чтения длины доменного имени: %w", err)
 		}
 		domainLen := int(lenBuf[0])
 		domain := make([]byte, domainLen)
-		_, err = io.ReadFull(conn, domain)
+		_, err = io.ReadFull(r, domain)
 		if err != nil {
-			return fmt.Errorf("ошибка чтения доменного имени: %w", err)
+			return "", 0, fmt.Errorf("ошибка чтения доменного имени: %w", err)
 		}
 		destAddr = string(domain)
 	case ipv6Address:
 		ipv6 := make([]byte, 16)
-		_, err = io.ReadFull(conn, ipv6)
+		_, err = io.ReadFull(r, ipv6)
 		if err != nil {
-			return fmt.Errorf("ошибка чтения IPv6 адреса: %w", err)
+			return "", 0, fmt.Errorf("ошибка чтения IPv6 адреса: %w", err)
 		}
 		destAddr = net.IP(ipv6).String()
 	default:
-		_, _ = conn.Write([]byte{socks5Version, 0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		return fmt.Errorf("неподдерживаемый тип адреса: %d", buf[3])
+		return "", 0, fmt.Errorf("%w: %d", errUnsupportedAddressType, atyp[0])
 	}
 
 	portBuf := make([]byte, 2)
-	_, err = io.ReadFull(conn, portBuf)
-	if err != nil {
-		return fmt.Errorf("ошибка чтения порта: %w", err)
-	}
-	destPort = int(portBuf[0])<<8 | int(portBuf[1])
-
-	target := net.JoinHostPort(destAddr, strconv.Itoa(destPort))
-
-	targetConn, err := net.Dial("tcp", target)
+	_, err = io.ReadFull(r, portBuf)
 	if err != nil {
-		log.Printf("Ошибка Dial к %s (запрошено %s от %s): %v", target, username, conn.RemoteAddr(), err)
-		_, _ = conn.Write([]byte{socks5Version, 0x05, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-		return fmt.Errorf("не удалось подключиться к целевому хосту: %w", err)
+		return "", 0, fmt.Errorf("ошибка чтения порта: %w", err)
 	}
-	defer targetConn.Close()
+	destPort := int(portBuf[0])<<8 | int(portBuf[1])
 
-	_, err = conn.Write([]byte{socks5Version, replySuccess, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	if err != nil {
-		return fmt.Errorf("ошибка отправки ответа об успехе: %w", err)
-	}
-
-	countryCode := getCountryCode(clientIP)
-	return proxyData(conn, targetConn, username, countryCode)
+	return destAddr, destPort, nil
 }
 
-// customWriter обертывает net.Conn и считает переданные байты
+// customWriter обертывает net.Conn, считает переданные байты в счётчике сессии
+// и, если заданы ограничители limits, выдерживает ограничение скорости
 type customWriter struct {
 	io.Writer
-	bytesWritten int64
+	counter *atomic.Int64
+	limits  []*tokenBucket
+	closed  <-chan struct{} // Закрытие сессии прерывает ожидание ограничителя
 }
 
 func (cw *customWriter) Write(p []byte) (n int, err error) {
-	n, err = cw.Writer.Write(p)
-	cw.bytesWritten += int64(n)
+	if len(cw.limits) > 0 {
+		n, err = limitedWrite(cw.Writer, p, cw.limits, cw.closed)
+	} else {
+		n, err = cw.Writer.Write(p)
+	}
+	cw.counter.Add(int64(n))
 	return
 }
 
-// proxyData теперь собирает статистику в память для пользователей и стран
-func proxyData(clientConn, targetConn net.Conn, username, countryCode string) error {
-	done := make(chan error, 2)
+// closeWriter - соединение, поддерживающее половинное закрытие (*net.TCPConn, *net.UnixConn)
+type closeWriter interface {
+	CloseWrite() error
+}
 
-	clientWriter := &customWriter{Writer: clientConn}
-	targetWriter := &customWriter{Writer: targetConn}
+// relayHalf копирует одно направление туннеля. Когда источник закончил передачу (FIN),
+// половинное закрытие передаётся получателю, а встречное направление продолжает работу.
+// При ошибке закрываются оба соединения, чтобы завершилось и встречное направление.
+func relayHalf(dst io.Writer, src, dstConn, srcConn net.Conn) error {
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		srcConn.Close()
+		dstConn.Close()
+		return err
+	}
+	if cw, ok := dstConn.(closeWriter); !ok || cw.CloseWrite() != nil {
+		// Половинное закрытие не поддерживается: без него получатель не узнает о конце данных
+		dstConn.Close()
+	}
+	return nil
+}
+
+// proxyData теперь собирает статистику в память для пользователей, стран и точек входа.
+// Байты учитываются по мере передачи (см. flushTrafficPeriodically). Сессия завершается,
+// когда обе стороны закончили передачу.
+func proxyData(sess *session, clientConn, targetConn net.Conn) error {
+	sess.addPeer(targetConn)
+	sess.startRelay()
+
+	uploadLimits, downloadLimits := sessionLimiters(sess)
+	clientWriter := &customWriter{Writer: clientConn, counter: &sess.pendingDownload, limits: downloadLimits, closed: sess.closed}
+	targetWriter := &customWriter{Writer: targetConn, counter: &sess.pendingUpload, limits: uploadLimits, closed: sess.closed}
 
+	upload := make(chan error, 1)
+	download := make(chan error, 1)
 	go func() {
-		_, err := io.Copy(targetWriter, clientConn) // clientConn (Reader) -> targetWriter (Writer)
-		done <- err
+		upload <- relayHalf(targetWriter, clientConn, targetConn, clientConn) // clientConn (Reader) -> targetWriter (Writer)
 	}()
 
 	go func() {
-		_, err := io.Copy(clientWriter, targetConn) // targetConn (Reader) -> clientWriter (Writer)
-		done <- err
+		download <- relayHalf(clientWriter, targetConn, clientConn, targetConn) // targetConn (Reader) -> clientWriter (Writer)
 	}()
 
-	err1 := <-done
-	err2 := <-done
+	err1 := <-upload
+	err2 := <-download
 
 	// Обновляем статистику в памяти
+	sess.flushTraffic()
+
+	if reason := sess.closedBy(); reason != "" {
+		return fmt.Errorf("сессия закрыта: %s", reason)
+	}
+	// Закрытие соединения после ошибки во встречном направлении - не отдельная ошибка
+	if err1 != nil && !errors.Is(err1, net.ErrClosed) {
+		return fmt.Errorf("ошибка копирования клиент -> цель: %w", err1)
+	}
+	if err2 != nil && !errors.Is(err2, net.ErrClosed) {
+		return fmt.Errorf("ошибка копирования цель -> клиент: %w", err2)
+	}
+	return nil
+}
+
+// addTraffic добавляет переданные байты к статистике пользователя, страны и точки входа
+func addTraffic(sess *session, upload, download int64) {
+	quota := userQuota(sess.username)
+
 	trafficMutex.Lock()
-	defer trafficMutex.Unlock()
+	exhausted := addQuotaUsage(sess.username, quota, upload+download)
+	defer func() {
+		trafficMutex.Unlock()
+		if exhausted {
+			quotaExhausted(sess.username)
+		}
+	}()
 
 	// Обновляем статистику пользователя
-	userStats := trafficStats[username]
-	userStats.UploadBytes += targetWriter.bytesWritten
-	userStats.DownloadBytes += clientWriter.bytesWritten
-	trafficStats[username] = userStats
+	userStats := trafficStats[sess.username]
+	userStats.UploadBytes += upload
+	userStats.DownloadBytes += download
+	trafficStats[sess.username] = userStats
 
 	// Обновляем статистику страны
-	if countryCode != "XX" {
-		cStats, ok := countryStats[countryCode]
+	if sess.countryCode != "XX" {
+		cStats, ok := countryStats[sess.countryCode]
 		if !ok {
 			cStats = &CountryStats{}
-			countryStats[countryCode] = cStats
+			countryStats[sess.countryCode] = cStats
 		}
-		cStats.UploadBytes += targetWriter.bytesWritten
-		cStats.DownloadBytes += clientWriter.bytesWritten
+		cStats.UploadBytes += upload
+		cStats.DownloadBytes += download
 		// Note: Connections are counted once per handleConnection, not here
 	}
 
-	if err1 != nil && err1 != io.EOF {
-		return fmt.Errorf("ошибка копирования клиент -> цель: %w", err1)
-	}
-	if err2 != nil && err2 != io.EOF {
-		return fmt.Errorf("ошибка копирования цель -> клиент: %w", err2)
+	// Обновляем статистику точки входа
+	lStats := listenerStatsFor(sess.listener.name)
+	lStats.UploadBytes += upload
+	lStats.DownloadBytes += download
+}
+
+// listenerStatsFor возвращает статистику слушателя, создавая её при необходимости.
+// Вызывается под trafficMutex.
+func listenerStatsFor(name string) *ListenerStats {
+	lStats, ok := listenerStats[name]
+	if !ok {
+		lStats = &ListenerStats{}
+		listenerStats[name] = lStats
 	}
-	return nil
+	return lStats
 }
 
-// saveStatsPeriodically собирает общую статистику и сохраняет её в файл
+// saveStatsPeriodically сохраняет статистику в файл раз в interval
 func saveStatsPeriodically(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		trafficMutex.RLock()
-		activeConnectionsMutex.Lock()
-
-		var totalUpload int64
-		var totalDownload int64
-
-		currentUserStats := make(map[string]UserTraffic)
-		for username, stats := range trafficStats {
-			totalUpload += stats.UploadBytes
-			totalDownload += stats.DownloadBytes
-			currentUserStats[username] = stats
-		}
-
-		// Копируем статистику по странам
-		currentCountryStats := make(map[string]*CountryStats)
-		for code, stats := range countryStats {
-			// Создаем копию, чтобы избежать гонки данных при параллельной записи
-			sCopy := *stats
-			currentCountryStats[code] = &sCopy
-		}
-
-		currentActiveConnections := activeConnectionsCounter
-
-		activeConnectionsMutex.Unlock()
-		trafficMutex.RUnlock()
-
-		globalStats := GlobalStats{
-			TotalUploadBytes:   totalUpload,
-			TotalDownloadBytes: totalDownload,
-			ActiveConnections:  currentActiveConnections,
-			UserStats:          currentUserStats,
-			CountryStats:       currentCountryStats, // Добавляем статистику по странам
-			LastUpdateTime:     time.Now(),
-		}
+		saveStats()
+	}
+}
 
-		// Сохраняем статистику в файл
-		file, err := os.OpenFile(statsFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			log.Printf("Ошибка при открытии/создании файла статистики %s: %v", statsFilePath, err)
-			continue
-		}
-		encoder := json.NewEncoder(file)
-		encoder.SetIndent("", "  ") // Для красивого форматирования JSON
-		if err := encoder.Encode(globalStats); err != nil {
-			log.Printf("Ошибка при записи статистики в файл %s: %v", statsFilePath, err)
-		}
-		file.Close()
+// saveStats собирает общую статистику и сохраняет её в файл
+func saveStats() {
+	statsFileMutex.Lock()
+	defer statsFileMutex.Unlock()
+
+	if statsHandedOff.Load() {
+		return // Файл статистики ведёт новый процесс
+	}
+
+	trafficMutex.RLock()
+	activeConnectionsMutex.Lock()
+
+	var totalUpload int64
+	var totalDownload int64
+
+	currentUserStats := make(map[string]UserTraffic)
+	for username, stats := range trafficStats {
+		totalUpload += stats.UploadBytes
+		totalDownload += stats.DownloadBytes
+		currentUserStats[username] = stats
+	}
+
+	// Копируем статистику по странам
+	currentCountryStats := make(map[string]*CountryStats)
+	for code, stats := range countryStats {
+		// Создаем копию, чтобы избежать гонки данных при параллельной записи
+		sCopy := *stats
+		currentCountryStats[code] = &sCopy
+	}
+
+	// Копируем статистику по точкам входа
+	currentListenerStats := make(map[string]*ListenerStats)
+	for name, stats := range listenerStats {
+		sCopy := *stats
+		currentListenerStats[name] = &sCopy
+	}
+
+	currentActiveConnections := activeConnectionsCounter
+	currentCountersSince := countersSince
+
+	activeConnectionsMutex.Unlock()
+	trafficMutex.RUnlock()
+
+	globalThrottle, userThrottle := throttleStats()
+	currentQuotaUsage := quotaStats()
+	currentUserConnections := userConnectionStats()
+	currentAccountStatus := accountStats()
+	currentAuthFailures := authFailureStats()
+	currentTimeouts := timeoutStats()
+	currentAcceptLimits := acceptLimitStats()
+
+	globalStats := GlobalStats{
+		TotalUploadBytes:   totalUpload,
+		TotalDownloadBytes: totalDownload,
+		ActiveConnections:  currentActiveConnections,
+		UserStats:          currentUserStats,
+		CountryStats:       currentCountryStats, // Добавляем статистику по странам
+		ListenerStats:      currentListenerStats,
+		GlobalThrottle:     globalThrottle,
+		UserThrottle:       userThrottle,
+		QuotaUsage:         currentQuotaUsage,
+		UserConnections:    currentUserConnections,
+		AccountStatus:      currentAccountStatus,
+		AuthFailures:       currentAuthFailures,
+		Timeouts:           currentTimeouts,
+		AcceptLimits:       currentAcceptLimits,
+		CountersSince:      currentCountersSince,
+		LastUpdateTime:     time.Now(),
+	}
+
+	// Сохраняем статистику в файл
+	data, err := json.MarshalIndent(globalStats, "", "  ") // Для красивого форматирования JSON
+	if err != nil {
+		log.Printf("Ошибка при кодировании статистики: %v", err)
+		return
+	}
+	if err := writeStatsFile(append(data, '\n')); err != nil {
+		log.Printf("Ошибка при записи статистики в файл %s: %v", config.StatsFile, err)
 	}
 }
 
@@ -489,26 +831,30 @@ func getCountryCode(ipStr string) string {
 	return record.Country.IsoCode
 }
 
-
 // loadUsersFromFile загружает пользователей из JSON-файла
 func loadUsersFromFile() error {
-	file, err := os.Open(usersFilePath)
+	file, err := os.Open(config.UsersFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			// Если файл не существует, создаем его с тестовыми данными
-			log.Printf("Инфо: Файл пользователей %s не найден. Создаю новый файл с пользователем 'astranet:astranet'.", usersFilePath)
+			// Если файл не существует, создаем его с тестовыми данными. Пароль
+			// сохраняется хешем argon2id, как после migrate-users.
+			log.Printf("Инфо: Файл пользователей %s не найден. Создаю новый файл с пользователем 'astranet:astranet', смените его пароль.", config.UsersFile)
+			hash, err := hashPassword("astranet", "argon2id")
+			if err != nil {
+				return fmt.Errorf("ошибка хеширования пароля пользователя по умолчанию: %w", err)
+			}
 			defaultUsers := map[string]User{
-				"astranet": {Username: "astranet", Password: "astranet", Enabled: true},
+				"astranet": {Username: "astranet", Password: hash, Enabled: true},
 			}
 			data, err := json.MarshalIndent(defaultUsers, "", "  ")
 			if err != nil {
 				return fmt.Errorf("ошибка кодирования JSON для пользователей по умолчанию: %w", err)
 			}
 			// Убедимся, что директория существует перед записью файла
-			if err := os.MkdirAll(filepath.Dir(usersFilePath), 0755); err != nil {
-				return fmt.Errorf("не удалось создать директорию для файла пользователей %s: %w", filepath.Dir(usersFilePath), err)
+			if err := os.MkdirAll(filepath.Dir(config.UsersFile), 0755); err != nil {
+				return fmt.Errorf("не удалось создать директорию для файла пользователей %s: %w", filepath.Dir(config.UsersFile), err)
 			}
-			if err := os.WriteFile(usersFilePath, data, 0644); err != nil {
+			if err := os.WriteFile(config.UsersFile, data, 0600); err != nil {
 				return fmt.Errorf("ошибка записи файла пользователей по умолчанию: %w", err)
 			}
 			usersMutex.Lock()
@@ -516,16 +862,16 @@ func loadUsersFromFile() error {
 			usersMutex.Unlock()
 			return nil
 		}
-		return fmt.Errorf("ошибка открытия файла пользователей %s: %w", usersFilePath, err)
+		return fmt.Errorf("ошибка открытия файла пользователей %s: %w", config.UsersFile, err)
 	}
-	defer file.Close()
+	file.Close()
 
-	var tempUsers map[string]User
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&tempUsers); err != nil {
-		return fmt.Errorf("ошибка декодирования JSON из файла пользователей %s: %w", usersFilePath, err)
+	tempUsers, err := readUsersFile(config.UsersFile)
+	if err != nil {
+		return err
 	}
 
+	warnPlaintextPasswords(tempUsers)
 	usersMutex.Lock()
 	users = tempUsers
 	usersMutex.Unlock()
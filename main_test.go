@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestProxyDataHalfClose проверяет, что половинное закрытие клиента доходит до цели,
+// а ответ цели после этого доходит до клиента по полуоткрытому соединению
+func TestProxyDataHalfClose(t *testing.T) {
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	connect := func(ln net.Listener) (dialed, accepted net.Conn) {
+		dialed, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		accepted, err = ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for _, c := range []net.Conn{dialed, accepted} {
+			t.Cleanup(func() { c.Close() })
+			_ = c.SetDeadline(deadline)
+		}
+		return dialed, accepted
+	}
+	client, clientConn := connect(listen())
+	targetConn, remote := connect(listen())
+
+	sess := &session{conn: clientConn, countryCode: "XX", listener: &proxyListener{name: "test"}, closed: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() { done <- proxyData(sess, clientConn, targetConn) }()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("запись клиента: %v", err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	// Цель дочитывает запрос до EOF и отвечает, пока клиент ждёт ответа
+	request, err := io.ReadAll(remote)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("цель получила %q, %v", request, err)
+	}
+	if _, err := remote.Write([]byte("response")); err != nil {
+		t.Fatalf("ответ цели: %v", err)
+	}
+	remote.Close()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("клиент получил %q, %v", response, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("proxyData: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Параметры argon2id для новых хешей (рекомендация OWASP: 19 МиБ, 2 итерации, 1 поток)
+const (
+	argon2Memory  = 19 * 1024
+	argon2Time    = 2
+	argon2Threads = 1
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	bcryptCost = 12
+)
+
+// Наибольшие параметры хешей, принимаемые из файла пользователей: проверка по хешу
+// с большими параметрами заняла бы память и процессор сервера
+const (
+	argon2MaxMemory  = 256 * 1024 // КиБ
+	argon2MaxTime    = 16
+	argon2MaxThreads = 16
+	argon2MaxSaltLen = 64
+	argon2MaxKeyLen  = 64
+
+	bcryptMaxCost = 16
+)
+
+var (
+	dummyHash     string // Хеш случайного пароля для проверки несуществующих пользователей
+	dummyHashOnce sync.Once
+
+	// hashSlots ограничивает число одновременных проверок по хешу: каждая проверка argon2id
+	// занимает десятки мегабайт, и поток попыток входа не должен исчерпать память
+	hashSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+)
+
+// dummyPasswordHash возвращает хеш argon2id с параметрами новых хешей. Проверка пароля
+// по нему занимает столько же времени, сколько проверка настоящего пользователя.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		password := make([]byte, 16)
+		_, _ = rand.Read(password)
+		dummyHash, _ = hashPassword(base64.RawStdEncoding.EncodeToString(password), "argon2id")
+	})
+	return dummyHash
+}
+
+// errBadHash возвращается для строки, похожей на хеш, но не разбираемой как PHC/bcrypt
+var errBadHash = errors.New("некорректный формат хеша пароля")
+
+// isPasswordHash сообщает, хранится ли пароль в виде хеша (argon2id или bcrypt)
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$argon2id$") || isBcryptHash(stored)
+}
+
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword сравнивает пароль с сохранённым значением за время, не зависящее
+// от совпадения и от способа хранения. Сохранённое значение - хеш argon2id/bcrypt
+// или открытый текст.
+// Проверки по хешу выполняются не более чем по hashSlots одновременно.
+func verifyPassword(stored, password string) (bool, error) {
+	if isPasswordHash(stored) {
+		hashSlots <- struct{}{}
+		defer func() { <-hashSlots }()
+	}
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		params, salt, hash, err := parseArgon2idHash(stored)
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(hash)))
+		return subtle.ConstantTimeCompare(computed, hash) == 1, nil
+	case isBcryptHash(stored):
+		err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	default:
+		// Открытый пароль проверяется не быстрее хеша: иначе по времени ответа было бы
+		// видно, у каких учётных записей пароль хранится открытым текстом
+		_, _ = verifyPassword(dummyPasswordHash(), password)
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, nil
+	}
+}
+
+// argon2Params - параметры из PHC-строки argon2id
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2idHash разбирает строку вида $argon2id$v=19$m=19456,t=2,p=1$<соль>$<хеш>
+func parseArgon2idHash(stored string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errBadHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: неподдерживаемая версия argon2 %q", errBadHash, parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("%w: параметры %q", errBadHash, parts[3])
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return params, nil, nil, fmt.Errorf("%w: нулевые параметры %q", errBadHash, parts[3])
+	}
+	if params.memory > argon2MaxMemory || params.time > argon2MaxTime || params.threads > argon2MaxThreads {
+		return params, nil, nil, fmt.Errorf("%w: параметры %q больше допустимых (m=%d,t=%d,p=%d)", errBadHash, parts[3],
+			argon2MaxMemory, argon2MaxTime, argon2MaxThreads)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) > argon2MaxSaltLen {
+		return params, nil, nil, fmt.Errorf("%w: соль", errBadHash)
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) == 0 || len(hash) > argon2MaxKeyLen {
+		return params, nil, nil, fmt.Errorf("%w: хеш", errBadHash)
+	}
+	return params, salt, hash, nil
+}
+
+// checkPasswordFormat проверяет, что сохранённый хеш можно использовать для сравнения
+func checkPasswordFormat(stored string) error {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		_, _, _, err := parseArgon2idHash(stored)
+		return err
+	case isBcryptHash(stored):
+		cost, err := bcrypt.Cost([]byte(stored))
+		if err != nil {
+			return fmt.Errorf("%w: %v", errBadHash, err)
+		}
+		if cost > bcryptMaxCost {
+			return fmt.Errorf("%w: стоимость bcrypt %d больше допустимой (%d)", errBadHash, cost, bcryptMaxCost)
+		}
+	}
+	return nil
+}
+
+// hashPassword создаёт хеш пароля в формате PHC (argon2id) или bcrypt
+func hashPassword(password, algo string) (string, error) {
+	switch algo {
+	case "argon2id":
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("не удалось получить случайную соль: %w", err)
+		}
+		hash := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+		if err != nil {
+			return "", fmt.Errorf("ошибка хеширования bcrypt: %w", err)
+		}
+		return string(hash), nil
+	default:
+		return "", fmt.Errorf("неизвестный алгоритм %q (ожидается argon2id или bcrypt)", algo)
+	}
+}
+
+// warnPlaintextPasswords предупреждает о пользователях с паролем в открытом виде
+func warnPlaintextPasswords(m map[string]User) {
+	var plaintext []string
+	for name, user := range m {
+		if !isPasswordHash(user.Password) {
+			plaintext = append(plaintext, name)
+		}
+	}
+	if len(plaintext) > 0 {
+		sort.Strings(plaintext)
+		log.Printf("Внимание: пароли пользователей %v хранятся в открытом виде. Выполните 'migrate-users', чтобы заменить их хешами.", plaintext)
+	}
+}
+
+// runHashPassword реализует подкоманду hash-password: читает пароль из первой строки stdin
+// и печатает его хеш для вставки в users.json
+func runHashPassword(args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	algo := fs.String("algo", "argon2id", "Алгоритм хеширования: argon2id или bcrypt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("ошибка чтения пароля: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return fmt.Errorf("пустой пароль")
+	}
+
+	hash, err := hashPassword(password, *algo)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+// runMigrateUsers реализует подкоманду migrate-users: заменяет открытые пароли
+// в файле пользователей хешами и атомарно перезаписывает файл
+func runMigrateUsers(args []string) error {
+	fs := flag.NewFlagSet("migrate-users", flag.ContinueOnError)
+	opts := &cliOptions{}
+	fs.StringVar(&opts.configPath, "config", "", "Путь к файлу конфигурации YAML (по умолчанию "+defaultConfigPath+")")
+	fs.StringVar(&opts.usersFile, "users-file", "", "Путь к файлу пользователей JSON")
+	algo := fs.String("algo", "argon2id", "Алгоритм хеширования: argon2id или bcrypt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg, _, err := loadConfig(opts, set)
+	if err != nil {
+		return err
+	}
+	path := cfg.UsersFile
+
+	m, err := readUsersFile(path)
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for name, user := range m {
+		if isPasswordHash(user.Password) {
+			continue
+		}
+		hash, err := hashPassword(user.Password, *algo)
+		if err != nil {
+			return fmt.Errorf("пользователь %q: %w", name, err)
+		}
+		user.Password = hash
+		m[name] = user
+		migrated++
+	}
+	if migrated == 0 {
+		fmt.Printf("В %s нет паролей в открытом виде\n", path)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка кодирования JSON: %w", err)
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	fmt.Printf("Захешировано паролей: %d (%s), файл %s обновлён\n", migrated, *algo, path)
+	return nil
+}
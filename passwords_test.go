@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseArgon2idHash(t *testing.T) {
+	const (
+		salt = "c29tZXNhbHRzb21lc2FsdA"                      // 16 байт
+		hash = "aGFzaGhhc2hoYXNoaGFzaGhhc2hoYXNoaGFzaGhhc2g" // 32 байта
+	)
+	long := strings.Repeat("QUFB", 22) // 66 байт
+
+	tests := []struct {
+		name   string
+		stored string
+		params argon2Params
+		ok     bool
+	}{
+		{"параметры по умолчанию", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + hash, argon2Params{19456, 2, 1}, true},
+		{"наибольшие параметры", "$argon2id$v=19$m=262144,t=16,p=16$" + salt + "$" + hash, argon2Params{262144, 16, 16}, true},
+		{"другой алгоритм", "$argon2i$v=19$m=19456,t=2,p=1$" + salt + "$" + hash, argon2Params{}, false},
+		{"не хватает частей", "$argon2id$v=19$m=19456,t=2,p=1$" + salt, argon2Params{}, false},
+		{"другая версия", "$argon2id$v=16$m=19456,t=2,p=1$" + salt + "$" + hash, argon2Params{}, false},
+		{"нет параметров", "$argon2id$v=19$m=19456$" + salt + "$" + hash, argon2Params{}, false},
+		{"нулевая память", "$argon2id$v=19$m=0,t=2,p=1$" + salt + "$" + hash, argon2Params{}, false},
+		{"слишком много памяти", "$argon2id$v=19$m=4194304,t=2,p=1$" + salt + "$" + hash, argon2Params{}, false},
+		{"слишком много итераций", "$argon2id$v=19$m=19456,t=1000,p=1$" + salt + "$" + hash, argon2Params{}, false},
+		{"слишком много потоков", "$argon2id$v=19$m=19456,t=2,p=64$" + salt + "$" + hash, argon2Params{}, false},
+		{"потоки вне uint8", "$argon2id$v=19$m=19456,t=2,p=300$" + salt + "$" + hash, argon2Params{}, false},
+		{"некорректная соль", "$argon2id$v=19$m=19456,t=2,p=1$!!!$" + hash, argon2Params{}, false},
+		{"слишком длинная соль", "$argon2id$v=19$m=19456,t=2,p=1$" + long + "$" + hash, argon2Params{}, false},
+		{"пустой хеш", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$", argon2Params{}, false},
+		{"слишком длинный хеш", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + long, argon2Params{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, _, _, err := parseArgon2idHash(tt.stored)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseArgon2idHash: %v, ожидалось корректно: %v", err, tt.ok)
+			}
+			if err != nil && !errors.Is(err, errBadHash) {
+				t.Errorf("ошибка %v не оборачивает errBadHash", err)
+			}
+			if tt.ok && params != tt.params {
+				t.Errorf("параметры = %+v, ожидалось %+v", params, tt.params)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordFormatBcryptCost(t *testing.T) {
+	fake := func(cost string) string { return "$2a$" + cost + "$" + strings.Repeat("a", 53) }
+	if err := checkPasswordFormat(fake("12")); err != nil {
+		t.Errorf("стоимость 12: %v", err)
+	}
+	if err := checkPasswordFormat(fake("20")); !errors.Is(err, errBadHash) {
+		t.Errorf("стоимость 20: %v, ожидалась ошибка errBadHash", err)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	for _, algo := range []string{"argon2id", "bcrypt"} {
+		stored, err := hashPassword("secret", algo)
+		if err != nil {
+			t.Fatalf("hashPassword(%s): %v", algo, err)
+		}
+		if ok, err := verifyPassword(stored, "secret"); !ok || err != nil {
+			t.Errorf("%s: верный пароль не принят: %v", algo, err)
+		}
+		if ok, err := verifyPassword(stored, "wrong"); ok || err != nil {
+			t.Errorf("%s: неверный пароль: %v, %v", algo, ok, err)
+		}
+	}
+	if ok, _ := verifyPassword("plain", "plain"); !ok {
+		t.Errorf("открытый пароль не принят")
+	}
+	if ok, _ := verifyPassword(dummyPasswordHash(), ""); ok {
+		t.Errorf("пустой пароль совпал с хешем-заглушкой")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Периоды квот
+const (
+	quotaDaily   = "daily"
+	quotaWeekly  = "weekly"
+	quotaMonthly = "monthly"
+)
+
+// errQuotaExceeded возвращается, когда пользователь израсходовал квоту текущего периода
+var errQuotaExceeded = errors.New("квота трафика исчерпана")
+
+// Quota задаёт квоту трафика пользователя на расчётный период (поле quota в users.json)
+type Quota struct {
+	Bytes    int64  `json:"bytes"`              // Сколько байт (upload + download) доступно за период
+	Period   string `json:"period"`             // daily, weekly или monthly
+	ResetDay int    `json:"resetDay,omitempty"` // День сброса: 1-7 (понедельник - воскресенье) для weekly, 1-31 для monthly; по умолчанию 1
+}
+
+// QuotaUsage - расход квоты пользователя в текущем периоде. В памяти используются
+// только PeriodStart и UsedBytes, остальные поля заполняются при сохранении статистики.
+type QuotaUsage struct {
+	Period         string    `json:"period"`
+	PeriodStart    time.Time `json:"periodStart"`
+	PeriodEnd      time.Time `json:"periodEnd"`
+	UsedBytes      int64     `json:"usedBytes"`
+	LimitBytes     int64     `json:"limitBytes"`
+	RemainingBytes int64     `json:"remainingBytes"`
+	Exceeded       bool      `json:"exceeded"`
+}
+
+var (
+	quotaUsage = make(map[string]*QuotaUsage) // Расход квот по пользователям, защищён trafficMutex
+	quotaSent  = make(map[string]*QuotaUsage) // Расход, уже переданный новому процессу при обновлении, защищён trafficMutex
+)
+
+// validate проверяет настройки квоты. Нулевая квота означает её отсутствие.
+func (q Quota) validate() error {
+	if q == (Quota{}) {
+		return nil
+	}
+	if q.Bytes <= 0 {
+		return fmt.Errorf("bytes должен быть больше нуля")
+	}
+	switch q.Period {
+	case quotaDaily:
+		if q.ResetDay != 0 {
+			return fmt.Errorf("resetDay не используется для периода daily")
+		}
+	case quotaWeekly:
+		if q.ResetDay < 0 || q.ResetDay > 7 {
+			return fmt.Errorf("resetDay для weekly - от 1 (понедельник) до 7 (воскресенье)")
+		}
+	case quotaMonthly:
+		if q.ResetDay < 0 || q.ResetDay > 31 {
+			return fmt.Errorf("resetDay для monthly - от 1 до 31")
+		}
+	default:
+		return fmt.Errorf("неизвестный период %q (ожидается daily, weekly или monthly)", q.Period)
+	}
+	return nil
+}
+
+// enabled сообщает, задана ли квота
+func (q Quota) enabled() bool {
+	return q.Bytes > 0
+}
+
+// periodBounds возвращает начало и конец расчётного периода, содержащего now.
+// Границы считаются по местному времени сервера.
+func (q Quota) periodBounds(now time.Time) (time.Time, time.Time) {
+	resetDay := q.ResetDay
+	if resetDay == 0 {
+		resetDay = 1
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	switch q.Period {
+	case quotaWeekly:
+		// time.Weekday: воскресенье = 0, в конфигурации воскресенье = 7
+		offset := (int(today.Weekday()) - resetDay%7 + 7) % 7
+		start := today.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7)
+	case quotaMonthly:
+		start := monthlyReset(now.Year(), now.Month(), resetDay, now.Location())
+		if today.Before(start) {
+			start = monthlyReset(now.Year(), now.Month()-1, resetDay, now.Location())
+		}
+		next := monthlyReset(start.Year(), start.Month()+1, resetDay, now.Location())
+		return start, next
+	default:
+		return today, today.AddDate(0, 0, 1)
+	}
+}
+
+// monthlyReset возвращает день сброса в указанном месяце. Если в месяце меньше дней
+// (resetDay 31 в феврале), сброс происходит в последний день месяца.
+func monthlyReset(year int, month time.Month, resetDay int, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	if last := first.AddDate(0, 1, -1).Day(); resetDay > last {
+		resetDay = last
+	}
+	return first.AddDate(0, 0, resetDay-1)
+}
+
+// userQuota возвращает квоту пользователя из users.json
+func userQuota(username string) Quota {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	return users[username].Quota
+}
+
+// addQuotaUsage учитывает байты в квоте пользователя. Возвращает true, если квота
+// была исчерпана именно этими байтами. Вызывается под trafficMutex.
+func addQuotaUsage(username string, q Quota, n int64) bool {
+	if !q.enabled() {
+		return false
+	}
+	start, _ := q.periodBounds(time.Now())
+	usage, ok := quotaUsage[username]
+	if !ok || !usage.PeriodStart.Equal(start) {
+		// Начался новый расчётный период
+		usage = &QuotaUsage{PeriodStart: start}
+		quotaUsage[username] = usage
+	}
+	before := usage.UsedBytes
+	usage.UsedBytes += n
+	return before < q.Bytes && usage.UsedBytes >= q.Bytes
+}
+
+// quotaExceeded сообщает, израсходовал ли пользователь квоту текущего периода
+func quotaExceeded(username string) bool {
+	q := userQuota(username)
+	if !q.enabled() {
+		return false
+	}
+	start, _ := q.periodBounds(time.Now())
+
+	trafficMutex.RLock()
+	defer trafficMutex.RUnlock()
+	usage, ok := quotaUsage[username]
+	return ok && usage.PeriodStart.Equal(start) && usage.UsedBytes >= q.Bytes
+}
+
+// quotaExhausted вызывается, когда пользователь исчерпал квоту во время работы сессий
+func quotaExhausted(username string) {
+	log.Printf("Пользователь %s исчерпал квоту трафика", username)
+	if !config.Quota.TerminateSessions {
+		return
+	}
+	if n := closeUserSessions(map[string]bool{username: true}); n > 0 {
+		log.Printf("Закрыто сессий пользователя %s после исчерпания квоты: %d", username, n)
+	}
+}
+
+// mergeQuotaUsage добавляет расход квот из сохранённой статистики или от предыдущего
+// процесса. Расход за уже закончившийся период отбрасывается. Вызывается под trafficMutex.
+func mergeQuotaUsage(delta map[string]*QuotaUsage) {
+	for username, d := range delta {
+		usage, ok := quotaUsage[username]
+		switch {
+		case !ok || d.PeriodStart.After(usage.PeriodStart):
+			quotaUsage[username] = &QuotaUsage{PeriodStart: d.PeriodStart, UsedBytes: d.UsedBytes}
+		case d.PeriodStart.Equal(usage.PeriodStart):
+			usage.UsedBytes += d.UsedBytes
+		}
+	}
+}
+
+// takeQuotaDelta возвращает расход квот, ещё не переданный новому процессу. Свой расход
+// процесс не обнуляет: сессии, которые завершаются после передачи слушателей,
+// по-прежнему ограничиваются квотой.
+func takeQuotaDelta() map[string]*QuotaUsage {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	delta := make(map[string]*QuotaUsage)
+	for username, usage := range quotaUsage {
+		used := usage.UsedBytes
+		if sent, ok := quotaSent[username]; ok && sent.PeriodStart.Equal(usage.PeriodStart) {
+			used -= sent.UsedBytes
+		}
+		if used > 0 {
+			delta[username] = &QuotaUsage{PeriodStart: usage.PeriodStart, UsedBytes: used}
+		}
+		quotaSent[username] = &QuotaUsage{PeriodStart: usage.PeriodStart, UsedBytes: usage.UsedBytes}
+	}
+	return delta
+}
+
+// quotaStats возвращает состояние квот всех пользователей, у которых они заданы
+func quotaStats() map[string]*QuotaUsage {
+	quotas := make(map[string]Quota)
+	usersMutex.RLock()
+	for username, user := range users {
+		if user.Quota.enabled() {
+			quotas[username] = user.Quota
+		}
+	}
+	usersMutex.RUnlock()
+
+	now := time.Now()
+	result := make(map[string]*QuotaUsage)
+	trafficMutex.RLock()
+	defer trafficMutex.RUnlock()
+	for username, q := range quotas {
+		start, end := q.periodBounds(now)
+		var used int64
+		if usage, ok := quotaUsage[username]; ok && usage.PeriodStart.Equal(start) {
+			used = usage.UsedBytes
+		}
+		result[username] = &QuotaUsage{
+			Period:         q.Period,
+			PeriodStart:    start,
+			PeriodEnd:      end,
+			UsedBytes:      used,
+			LimitBytes:     q.Bytes,
+			RemainingBytes: max(q.Bytes-used, 0),
+			Exceeded:       used >= q.Bytes,
+		}
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriodBounds(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		quota      Quota
+		now        time.Time
+		start, end time.Time
+	}{
+		{"daily", Quota{Period: quotaDaily}, time.Date(2026, 3, 15, 13, 45, 0, 0, time.UTC), day(2026, 3, 15), day(2026, 3, 16)},
+		{"daily в полночь", Quota{Period: quotaDaily}, day(2026, 3, 16), day(2026, 3, 16), day(2026, 3, 17)},
+		{"weekly с понедельника", Quota{Period: quotaWeekly}, time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), day(2026, 10, 12), day(2026, 10, 19)},
+		{"weekly с воскресенья", Quota{Period: quotaWeekly, ResetDay: 7}, day(2026, 10, 16), day(2026, 10, 11), day(2026, 10, 18)},
+		{"weekly в день сброса", Quota{Period: quotaWeekly, ResetDay: 5}, day(2026, 10, 16), day(2026, 10, 16), day(2026, 10, 23)},
+		{"monthly с первого числа", Quota{Period: quotaMonthly}, day(2026, 10, 16), day(2026, 10, 1), day(2026, 11, 1)},
+		{"monthly до дня сброса", Quota{Period: quotaMonthly, ResetDay: 20}, day(2026, 10, 16), day(2026, 9, 20), day(2026, 10, 20)},
+		{"monthly через новый год", Quota{Period: quotaMonthly, ResetDay: 15}, day(2026, 1, 10), day(2025, 12, 15), day(2026, 1, 15)},
+		{"monthly 31 в феврале", Quota{Period: quotaMonthly, ResetDay: 31}, day(2026, 2, 28), day(2026, 2, 28), day(2026, 3, 31)},
+		{"monthly 31 до конца февраля", Quota{Period: quotaMonthly, ResetDay: 31}, day(2026, 2, 27), day(2026, 1, 31), day(2026, 2, 28)},
+		{"monthly 31 в марте", Quota{Period: quotaMonthly, ResetDay: 31}, day(2026, 3, 30), day(2026, 2, 28), day(2026, 3, 31)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := tt.quota.periodBounds(tt.now)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("periodBounds(%s) = %s - %s, ожидалось %s - %s", tt.now, start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestAddQuotaUsageRollover(t *testing.T) {
+	saved := quotaUsage
+	defer func() { quotaUsage = saved }()
+	quotaUsage = make(map[string]*QuotaUsage)
+
+	q := Quota{Bytes: 100, Period: quotaDaily}
+	start, _ := q.periodBounds(time.Now())
+
+	// Квота, исчерпанная в прошлом периоде, не мешает в новом
+	quotaUsage["u"] = &QuotaUsage{PeriodStart: start.AddDate(0, 0, -1), UsedBytes: 500}
+	if addQuotaUsage("u", q, 60) {
+		t.Fatalf("квота исчерпана сразу после начала нового периода")
+	}
+	usage := quotaUsage["u"]
+	if !usage.PeriodStart.Equal(start) || usage.UsedBytes != 60 {
+		t.Fatalf("расход = %s, %d, ожидалось %s, 60", usage.PeriodStart, usage.UsedBytes, start)
+	}
+	if !addQuotaUsage("u", q, 40) {
+		t.Errorf("не сообщено об исчерпании квоты")
+	}
+	if addQuotaUsage("u", q, 10) {
+		t.Errorf("об исчерпании квоты сообщено повторно")
+	}
+
+	// Сохранённый расход за прошлый период отбрасывается, за текущий - добавляется
+	mergeQuotaUsage(map[string]*QuotaUsage{"u": {PeriodStart: start.AddDate(0, 0, -1), UsedBytes: 1000}})
+	if quotaUsage["u"].UsedBytes != 110 {
+		t.Errorf("после расхода за прошлый период UsedBytes = %d, ожидалось 110", quotaUsage["u"].UsedBytes)
+	}
+	mergeQuotaUsage(map[string]*QuotaUsage{"u": {PeriodStart: start, UsedBytes: 5}})
+	if quotaUsage["u"].UsedBytes != 115 {
+		t.Errorf("после расхода за текущий период UsedBytes = %d, ожидалось 115", quotaUsage["u"].UsedBytes)
+	}
+}
+
+func TestTakeQuotaDelta(t *testing.T) {
+	savedUsage, savedSent := quotaUsage, quotaSent
+	defer func() { quotaUsage, quotaSent = savedUsage, savedSent }()
+	start := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	quotaUsage = map[string]*QuotaUsage{"u": {PeriodStart: start, UsedBytes: 100}}
+	quotaSent = make(map[string]*QuotaUsage)
+
+	// Первая передача отдаёт весь расход, но у себя его не обнуляет
+	if delta := takeQuotaDelta(); delta["u"] == nil || delta["u"].UsedBytes != 100 {
+		t.Fatalf("первая передача = %+v, ожидалось 100", delta["u"])
+	}
+	if quotaUsage["u"].UsedBytes != 100 {
+		t.Fatalf("после передачи UsedBytes = %d, ожидалось 100", quotaUsage["u"].UsedBytes)
+	}
+
+	// Вторая - только расход завершившихся после передачи сессий
+	quotaUsage["u"].UsedBytes += 30
+	if delta := takeQuotaDelta(); delta["u"] == nil || delta["u"].UsedBytes != 30 {
+		t.Fatalf("вторая передача = %+v, ожидалось 30", delta["u"])
+	}
+	if delta := takeQuotaDelta(); len(delta) != 0 {
+		t.Errorf("повторная передача без расхода = %+v", delta)
+	}
+}
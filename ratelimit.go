@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitChunk - наибольшая порция записи при ограничении скорости, чтобы поток шёл ровно
+	rateLimitChunk = 16 * 1024
+	// throttleRecent - сколько после последней задержки ограничитель считается активным
+	throttleRecent = 2 * time.Second
+)
+
+// RateLimit задаёт ограничения скорости в байтах в секунду; 0 - без ограничения.
+// Используется в users.json для пользователя и в секции rateLimit конфигурации.
+type RateLimit struct {
+	Upload             int64 `json:"upload,omitempty" yaml:"upload"`                         // Суммарно по всем соединениям (клиент -> цель)
+	Download           int64 `json:"download,omitempty" yaml:"download"`                     // Суммарно по всем соединениям (цель -> клиент)
+	ConnectionUpload   int64 `json:"connectionUpload,omitempty" yaml:"connectionUpload"`     // На одно соединение
+	ConnectionDownload int64 `json:"connectionDownload,omitempty" yaml:"connectionDownload"` // На одно соединение
+}
+
+// validate проверяет, что ограничения не отрицательные
+func (r RateLimit) validate() error {
+	if r.Upload < 0 || r.Download < 0 || r.ConnectionUpload < 0 || r.ConnectionDownload < 0 {
+		return fmt.Errorf("скорость не может быть отрицательной")
+	}
+	return nil
+}
+
+// ThrottleStats - текущее состояние ограничения скорости для статистики
+type ThrottleStats struct {
+	UploadLimit      int64   `json:"uploadLimit"`      // Байт/с, 0 - без ограничения
+	DownloadLimit    int64   `json:"downloadLimit"`    // Байт/с, 0 - без ограничения
+	Throttled        bool    `json:"throttled"`        // Передача сейчас притормаживается
+	ThrottledSeconds float64 `json:"throttledSeconds"` // Суммарное время задержек с момента запуска
+}
+
+// tokenBucket - ограничитель скорости «ведро с токенами». Ёмкость ведра - одна
+// секунда трафика; запись может взять токены в долг и затем ждёт их восполнения.
+type tokenBucket struct {
+	mu          sync.Mutex
+	rate        int64 // Байт в секунду; 0 - без ограничения
+	tokens      float64
+	last        time.Time
+	throttledAt time.Time     // Время последней задержки
+	waited      time.Duration // Суммарное время задержек
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// refillLocked добавляет токены за прошедшее время. Вызывается под b.mu.
+func (b *tokenBucket) refillLocked(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if capacity := float64(b.rate); b.tokens > capacity {
+			b.tokens = capacity
+		}
+	}
+	b.last = now
+}
+
+// setRate меняет скорость; накопленный долг сохраняется
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refillLocked(time.Now())
+	if b.rate <= 0 && rate > 0 {
+		b.tokens = float64(rate)
+	}
+	b.rate = rate
+}
+
+// reserve списывает n байт и возвращает, сколько нужно подождать перед их отправкой
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	b.refillLocked(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	b.throttledAt = now
+	b.waited += wait
+	return wait
+}
+
+// fitsLocked проверяет, есть ли в ведре токены на датаграмму размера n. Больше
+// ёмкости ведра не требуется: датаграмма крупнее секундного ограничения проходит
+// при полном ведре и берёт остаток в долг, иначе она не прошла бы никогда.
+// Вызывается под b.mu.
+func (b *tokenBucket) fitsLocked(now time.Time, n int) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.refillLocked(now)
+	if b.tokens < min(float64(n), float64(b.rate)) {
+		b.throttledAt = now
+		return false
+	}
+	return true
+}
+
+// state возвращает скорость и признак недавней задержки
+func (b *tokenBucket) state() (rate int64, throttled bool, waited time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate, !b.throttledAt.IsZero() && time.Since(b.throttledAt) < throttleRecent, b.waited
+}
+
+// bandwidthLimiter - пара ограничителей для направлений upload и download
+type bandwidthLimiter struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+func newBandwidthLimiter(upload, download int64) *bandwidthLimiter {
+	return &bandwidthLimiter{upload: newTokenBucket(upload), download: newTokenBucket(download)}
+}
+
+func (l *bandwidthLimiter) setRates(upload, download int64) {
+	l.upload.setRate(upload)
+	l.download.setRate(download)
+}
+
+func (l *bandwidthLimiter) stats() *ThrottleStats {
+	upRate, upThrottled, upWaited := l.upload.state()
+	downRate, downThrottled, downWaited := l.download.state()
+	return &ThrottleStats{
+		UploadLimit:      upRate,
+		DownloadLimit:    downRate,
+		Throttled:        upThrottled || downThrottled,
+		ThrottledSeconds: (upWaited + downWaited).Seconds(),
+	}
+}
+
+var (
+	globalLimiter *bandwidthLimiter                    // Общее ограничение сервера (секция rateLimit)
+	userLimiters  = make(map[string]*bandwidthLimiter) // Ограничители пользователей с активными сессиями
+	limitersMutex sync.Mutex                           // Мьютекс для доступа к globalLimiter и userLimiters
+)
+
+// userRateLimit возвращает ограничения пользователя из users.json
+func userRateLimit(username string) RateLimit {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	return users[username].RateLimit
+}
+
+// sessionLimiters возвращает ограничители для соединения сессии: собственные
+// ограничители соединения, ограничители пользователя и общие
+func sessionLimiters(sess *session) (upload, download []*tokenBucket) {
+	limit := userRateLimit(sess.username)
+
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	if globalLimiter == nil {
+		globalLimiter = newBandwidthLimiter(config.RateLimit.Upload, config.RateLimit.Download)
+	}
+	userLimiter, ok := userLimiters[sess.username]
+	if !ok {
+		userLimiter = newBandwidthLimiter(limit.Upload, limit.Download)
+		userLimiters[sess.username] = userLimiter
+	}
+
+	// Ограничение на соединение из users.json, иначе из конфигурации
+	connUpload, connDownload := limit.ConnectionUpload, limit.ConnectionDownload
+	if connUpload == 0 {
+		connUpload = config.RateLimit.ConnectionUpload
+	}
+	if connDownload == 0 {
+		connDownload = config.RateLimit.ConnectionDownload
+	}
+
+	// Ограничитель пользователя подключается всегда: новые ограничения из users.json
+	// действуют и на уже открытые соединения
+	upload = append(connectionBucket(connUpload), userLimiter.upload)
+	download = append(connectionBucket(connDownload), userLimiter.download)
+	if config.RateLimit.Upload > 0 {
+		upload = append(upload, globalLimiter.upload)
+	}
+	if config.RateLimit.Download > 0 {
+		download = append(download, globalLimiter.download)
+	}
+	return upload, download
+}
+
+// releaseUserLimiterLocked удаляет ограничитель пользователя, у которого не осталось
+// сессий, чтобы userLimiters не рос с каждым когда-либо подключавшимся пользователем.
+// Вызывается под sessionsMutex после удаления сессии из реестра: новая сессия получает
+// ограничитель только после setUsername, поэтому живой ограничитель не удаляется.
+func releaseUserLimiterLocked(username string) {
+	if username == "" {
+		return
+	}
+	for s := range sessions {
+		if s.username == username {
+			return
+		}
+	}
+	limitersMutex.Lock()
+	delete(userLimiters, username)
+	limitersMutex.Unlock()
+}
+
+// connectionBucket возвращает собственный ограничитель соединения, если скорость ограничена
+func connectionBucket(rate int64) []*tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return []*tokenBucket{newTokenBucket(rate)}
+}
+
+// updateUserRateLimits применяет новые ограничения из users.json к уже созданным
+// ограничителям; действует и на открытые соединения
+func updateUserRateLimits() {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	for username, l := range userLimiters {
+		limit := users[username].RateLimit
+		l.setRates(limit.Upload, limit.Download)
+	}
+}
+
+// throttleStats возвращает состояние общего ограничителя и ограничителей пользователей,
+// у которых задано ограничение
+func throttleStats() (*ThrottleStats, map[string]*ThrottleStats) {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	var global *ThrottleStats
+	if globalLimiter != nil && (config.RateLimit.Upload > 0 || config.RateLimit.Download > 0) {
+		global = globalLimiter.stats()
+	}
+	perUser := make(map[string]*ThrottleStats)
+	for username, l := range userLimiters {
+		if s := l.stats(); s.UploadLimit > 0 || s.DownloadLimit > 0 {
+			perUser[username] = s
+		}
+	}
+	return global, perUser
+}
+
+// waitBuckets резервирует n байт во всех ограничителях и ждёт самую долгую задержку.
+// Возвращает false, если сессия закрылась во время ожидания.
+func waitBuckets(buckets []*tokenBucket, n int, closed <-chan struct{}) bool {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-closed:
+		return false
+	}
+}
+
+// allowBuckets списывает датаграмму размера n, только если она укладывается во все
+// ограничители; иначе не списывает ни из одного. Для UDP: датаграмма, превышающая
+// ограничение, отбрасывается, а не задерживается. Ограничители блокируются в порядке
+// списка (соединение, пользователь, общий), он одинаков у всех сессий.
+func allowBuckets(buckets []*tokenBucket, n int) bool {
+	now := time.Now()
+	for _, b := range buckets {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+	for _, b := range buckets {
+		if !b.fitsLocked(now, n) {
+			return false
+		}
+	}
+	for _, b := range buckets {
+		if b.rate > 0 {
+			b.tokens -= float64(n)
+		}
+	}
+	return true
+}
+
+// limitedWrite записывает p порциями не больше rateLimitChunk, дожидаясь токенов
+func limitedWrite(w io.Writer, p []byte, buckets []*tokenBucket, closed <-chan struct{}) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunk {
+			chunk = chunk[:rateLimitChunk]
+		}
+		if !waitBuckets(buckets, len(chunk), closed) {
+			return written, net.ErrClosed
+		}
+		n, err := w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAllowBuckets(t *testing.T) {
+	conn, user := newTokenBucket(1000), newTokenBucket(100)
+	buckets := []*tokenBucket{conn, user}
+
+	// Отказ второго ограничителя не списывает токены из первого
+	user.tokens = 50
+	if allowBuckets(buckets, 80) {
+		t.Fatalf("датаграмма 80 байт прошла при 50 токенах")
+	}
+	if conn.tokens < 999 {
+		t.Errorf("после отказа в первом ограничителе осталось %.0f токенов, ожидалось 1000", conn.tokens)
+	}
+
+	// Датаграмма больше секундного ограничения проходит при полном ведре и уходит в долг
+	user.tokens = 100
+	if !allowBuckets(buckets, 150) {
+		t.Fatalf("датаграмма больше ёмкости ведра не прошла при полном ведре")
+	}
+	if user.tokens > -49 {
+		t.Errorf("после крупной датаграммы осталось %.0f токенов, ожидался долг 50", user.tokens)
+	}
+	if allowBuckets(buckets, 1) {
+		t.Errorf("датаграмма прошла, пока ограничитель в долгу")
+	}
+}
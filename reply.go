@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// appendSocks5Address дописывает ATYP, адрес и порт в формате SOCKS5.
+// Неизвестный или пустой IP кодируется как 0.0.0.0.
+func appendSocks5Address(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, ipv4Address)
+		b = append(b, ip4...)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		b = append(b, ipv6Address)
+		b = append(b, ip16...)
+	} else {
+		b = append(b, ipv4Address, 0x00, 0x00, 0x00, 0x00)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeSocks5Reply отправляет ответ SOCKS5 с кодом rep и адресом BND.ADDR/BND.PORT.
+// Если addr равен nil, отправляется 0.0.0.0:0.
+func writeSocks5Reply(conn net.Conn, rep byte, addr net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	reply := appendSocks5Address([]byte{socks5Version, rep, 0x00}, ip, port)
+	_, err := conn.Write(reply)
+	return err
+}
+
+// dialErrorReply подбирает код ответа SOCKS5 (RFC 1928, поле REP) по ошибке установки соединения
+func dialErrorReply(err error) byte {
+	if errors.Is(err, errDestinationDenied) {
+		return replyNotAllowed
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return replyTTLExpired
+		}
+		// NXDOMAIN и прочие ошибки разрешения имени: до хоста не добраться
+		return replyHostUnreachable
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return replyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return replyHostUnreachable
+	case errors.Is(err, syscall.ETIMEDOUT), errors.Is(err, os.ErrDeadlineExceeded):
+		return replyTTLExpired
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		// Соединение запрещено локальными правилами (например, межсетевым экраном)
+		return replyNotAllowed
+	case errors.Is(err, syscall.EAFNOSUPPORT):
+		return replyAddressTypeNotSupported
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return replyTTLExpired
+	}
+	return replyGeneralFailure
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficFlushInterval - как часто байты активных сессий переносятся в общую статистику
+const trafficFlushInterval = time.Second
+
+// session описывает одно клиентское соединение с прокси
+type session struct {
+	conn        net.Conn       // Клиентское соединение; закрытие завершает сессию
+	clientIP    string         // IP клиента ("local" для Unix-сокета)
+	countryCode string         // Код страны клиента ("XX", если неизвестен)
+	listener    *proxyListener // Точка входа, принявшая соединение
+	admission   *connAdmission // Места, занятые соединением в ограничениях приёма (limits)
+	username    string         // Пользователь, определённый при аутентификации
+	started     time.Time      // Время подключения
+	admitted    bool           // Сессия прошла проверку ограничений пользователя (см. admitSession)
+	peers       []io.Closer    // Соединения с целевыми хостами и сокеты, закрываются вместе с сессией
+	closed      chan struct{}  // Закрывается при принудительном закрытии сессии
+	closeReason string         // Почему сессия закрыта сервером (таймаут), под sessionsMutex
+	closeOnce   sync.Once
+
+	lastActivity atomic.Int64 // Время последней передачи данных, UnixNano (см. checkTimeouts)
+	relaying     atomic.Bool  // Начата передача данных; до этого простой не проверяется
+
+	// Байты, ещё не перенесённые в статистику пользователя, страны и точки входа
+	pendingUpload   atomic.Int64
+	pendingDownload atomic.Int64
+}
+
+// Реестр активных сессий
+var (
+	sessions      = make(map[*session]struct{})
+	sessionsMutex sync.Mutex // Мьютекс для доступа к sessions и session.username из других горутин
+
+	sessionsWG sync.WaitGroup // Обработчики соединений; используется при остановке сервера
+
+	acceptStopped bool       // Сервер останавливается, новые обработчики не запускаются
+	handlersMutex sync.Mutex // Мьютекс для acceptStopped; sessionsWG.Add выполняется под ним
+)
+
+func registerSession(s *session) {
+	sessionsMutex.Lock()
+	sessions[s] = struct{}{}
+	sessionsMutex.Unlock()
+}
+
+func unregisterSession(s *session) {
+	sessionsMutex.Lock()
+	delete(sessions, s)
+	releaseUserLimiterLocked(s.username)
+	sessionsMutex.Unlock()
+	s.flushTraffic()
+}
+
+// flushTraffic переносит накопленные байты сессии в общую статистику
+func (s *session) flushTraffic() {
+	upload, download := s.pendingUpload.Swap(0), s.pendingDownload.Swap(0)
+	if upload != 0 || download != 0 {
+		s.lastActivity.Store(time.Now().UnixNano())
+		addTraffic(s, upload, download)
+	}
+}
+
+// flushTrafficPeriodically раз в trafficFlushInterval учитывает трафик активных сессий,
+// чтобы долгие туннели были видны в статистике сразу, а не после закрытия, и закрывает
+// простаивающие и слишком долгие сессии (timeouts.idle, timeouts.maxLifetime)
+func flushTrafficPeriodically() {
+	ticker := time.NewTicker(trafficFlushInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sessionsMutex.Lock()
+		active := make([]*session, 0, len(sessions))
+		for s := range sessions {
+			active = append(active, s)
+		}
+		sessionsMutex.Unlock()
+
+		for _, s := range active {
+			s.flushTraffic()
+			s.checkTimeouts(now)
+		}
+	}
+}
+
+// finishHandshake отмечает, что запрос клиента прочитан: снимает таймаут рукопожатия
+// и освобождает место maxPendingHandshakes. Дальше действуют таймауты соединения,
+// простоя и длительности сессии.
+func (s *session) finishHandshake() {
+	_ = s.conn.SetDeadline(time.Time{})
+	s.admission.handshakeDone()
+}
+
+// setUsername запоминает пользователя сессии после успешной аутентификации
+func (s *session) setUsername(username string) {
+	sessionsMutex.Lock()
+	s.username = username
+	sessionsMutex.Unlock()
+}
+
+// addPeer регистрирует соединение с целевым хостом, чтобы закрыть его при завершении сессии
+func (s *session) addPeer(c io.Closer) {
+	sessionsMutex.Lock()
+	s.peers = append(s.peers, c)
+	sessionsMutex.Unlock()
+}
+
+// closeLocked закрывает клиентское соединение и все соединения с целевыми хостами.
+// Вызывается под sessionsMutex.
+func (s *session) closeLocked() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.conn.Close()
+	for _, c := range s.peers {
+		c.Close()
+	}
+}
+
+// closeUserSessions закрывает все сессии указанных пользователей и возвращает их число
+func closeUserSessions(usernames map[string]bool) int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	closed := 0
+	for s := range sessions {
+		if s.username != "" && usernames[s.username] {
+			s.closeLocked()
+			closed++
+		}
+	}
+	return closed
+}
+
+// closeAllSessions закрывает все активные сессии и возвращает их число
+func closeAllSessions() int {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for s := range sessions {
+		s.closeLocked()
+	}
+	return len(sessions)
+}
+
+// startSession учитывает новый обработчик соединения в sessionsWG. Возвращает false,
+// если сервер уже останавливается: тогда соединение не обслуживается.
+func startSession() bool {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	if acceptStopped {
+		return false
+	}
+	sessionsWG.Add(1)
+	return true
+}
+
+// stopAccepting запрещает запуск новых обработчиков. После неё sessionsWG.Add больше
+// не вызывается, и ожидание сессий при остановке не гонится с приёмом соединений.
+func stopAccepting() {
+	handlersMutex.Lock()
+	acceptStopped = true
+	handlersMutex.Unlock()
+}
+
+// waitSessions ждёт завершения всех обработчиков соединений не дольше timeout.
+// Возвращает false, если время вышло.
+func waitSessions(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		sessionsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
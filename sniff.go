@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+// peekConn позволяет заглянуть в начало потока, не теряя прочитанные байты.
+// Используется для определения протокола клиента на общем порту.
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func newPeekConn(conn net.Conn) *peekConn {
+	return &peekConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Peek возвращает первые n байт потока, не извлекая их
+func (c *peekConn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+func (c *peekConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite передаёт половинное закрытие исходному соединению, если оно его поддерживает
+func (c *peekConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4ReplyVersion  = 0x00
+	socks4Granted       = 0x5A // 90: запрос удовлетворён
+	socks4Rejected      = 0x5B // 91: запрос отклонён или не выполнен
+	socks4UserIDInvalid = 0x5D // 93: USERID не совпадает с известным пользователем
+
+	socks4MaxFieldLen = 255 // Ограничение длины USERID и доменного имени
+)
+
+// handleSocks4 обрабатывает запрос SOCKS4/SOCKS4a. Поле USERID сопоставляется
+// с именем пользователя из users; пароля в протоколе SOCKS4 нет.
+func handleSocks4(conn *peekConn, sess *session) error {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения запроса SOCKS4: %w", err)
+	}
+	command := header[1]
+	destPort := int(header[2])<<8 | int(header[3])
+	destIP := net.IPv4(header[4], header[5], header[6], header[7])
+
+	userID, err := readNullTerminated(conn.r)
+	if err != nil {
+		return fmt.Errorf("ошибка чтения USERID SOCKS4: %w", err)
+	}
+
+	// SOCKS4a: адрес 0.0.0.x (x != 0) означает, что за USERID следует доменное имя
+	destAddr := destIP.String()
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		destAddr, err = readNullTerminated(conn.r)
+		if err != nil {
+			return fmt.Errorf("ошибка чтения доменного имени SOCKS4a: %w", err)
+		}
+	}
+	sess.finishHandshake()
+
+	username, ok := socks4Username(userID, sess.clientIP, sess.listener.auth)
+	if !ok {
+		log.Printf("SOCKS4: аутентификация не удалась для USERID %q (с %s)", userID, conn.RemoteAddr())
+		time.Sleep(recordAuthFailure(sess.clientIP, userID))
+		_ = writeSocks4Reply(conn, socks4UserIDInvalid, nil)
+		return fmt.Errorf("пользователь %q неизвестен, неактивен или не допущен к SOCKS4", userID)
+	}
+	log.Printf("SOCKS4: аутентификация успешна для пользователя: %s (с %s)", username, conn.RemoteAddr())
+	sess.setUsername(username)
+
+	if err := checkUserAccess(sess); err != nil {
+		_ = writeSocks4Reply(conn, socks4Rejected, nil)
+		return err
+	}
+
+	if command != connectCommand {
+		_ = writeSocks4Reply(conn, socks4Rejected, nil)
+		return fmt.Errorf("неподдерживаемая команда SOCKS4: %d", command)
+	}
+
+	target := net.JoinHostPort(destAddr, strconv.Itoa(destPort))
+	targetConn, err := dialDestination(sess, destAddr, destPort)
+	if err != nil {
+		log.Printf("Ошибка Dial к %s (запрошено %s от %s по SOCKS4): %v", target, username, conn.RemoteAddr(), err)
+		_ = writeSocks4Reply(conn, socks4Rejected, nil)
+		return fmt.Errorf("не удалось подключиться к целевому хосту: %w", err)
+	}
+	defer targetConn.Close()
+
+	if err := writeSocks4Reply(conn, socks4Granted, targetConn.LocalAddr()); err != nil {
+		return fmt.Errorf("ошибка отправки ответа SOCKS4: %w", err)
+	}
+
+	return proxyData(sess, conn, targetConn)
+}
+
+// socks4Username определяет пользователя по USERID. В SOCKS4 нет пароля, поэтому
+// по USERID входят только пользователи с socks4: true в users.json. Клиентам из сетей
+// без аутентификации пустой USERID разрешён и записывается на псевдопользователя.
+func socks4Username(userID, clientIP string, policy *authPolicy) (string, bool) {
+	usersMutex.RLock()
+	user, ok := users[userID]
+	usersMutex.RUnlock()
+	if ok && user.SOCKS4 && user.Enabled && user.accessError(time.Now()) == nil && !socks4Locked(clientIP, userID) {
+		return userID, true
+	}
+	if userID == "" && policy.allowsNoAuth(clientIP) {
+		return policy.noAuthUser, true
+	}
+	return "", false
+}
+
+// socks4Locked сообщает, заблокирована ли учётная запись для адреса клиента
+func socks4Locked(clientIP, userID string) bool {
+	locked, _ := userLocked(clientIP, userID)
+	return locked
+}
+
+// readNullTerminated читает строку, завершающуюся нулевым байтом
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0x00 {
+			return string(field), nil
+		}
+		if len(field) >= socks4MaxFieldLen {
+			return "", fmt.Errorf("поле длиннее %d байт", socks4MaxFieldLen)
+		}
+		field = append(field, b)
+	}
+}
+
+// writeSocks4Reply отправляет ответ SOCKS4. В DSTPORT/DSTIP передаётся адрес addr,
+// если он IPv4, иначе нули.
+func writeSocks4Reply(conn net.Conn, code byte, addr net.Addr) error {
+	reply := []byte{socks4ReplyVersion, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+			reply[2], reply[3] = byte(tcpAddr.Port>>8), byte(tcpAddr.Port)
+			copy(reply[4:], ip4)
+		}
+	}
+	_, err := conn.Write(reply)
+	return err
+}
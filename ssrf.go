@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// protectedRanges - внутренние сети, соединения с которыми по умолчанию запрещены:
+// через них прокси открыл бы доступ к самому серверу, его локальной сети и
+// службе метаданных облака (169.254.169.254). Кроме них защищаются адреса
+// сетевых интерфейсов самого сервера (см. compile).
+var protectedRanges = []struct {
+	cidr, kind string
+}{
+	{"0.0.0.0/8", "unspecified"},
+	{"127.0.0.0/8", "loopback"},
+	{"10.0.0.0/8", "RFC 1918"},
+	{"172.16.0.0/12", "RFC 1918"},
+	{"192.168.0.0/16", "RFC 1918"},
+	{"169.254.0.0/16", "link-local"},
+	{"100.64.0.0/10", "CGNAT"},
+	{"224.0.0.0/4", "multicast"},
+	{"255.255.255.255/32", "broadcast"},
+	{"::/128", "unspecified"},
+	{"::1/128", "loopback"},
+	{"fe80::/10", "link-local"},
+	{"fc00::/7", "ULA"},
+	{"64:ff9b::/96", "NAT64"},
+	{"ff00::/8", "multicast"},
+}
+
+// ProtectedNetworksConfig задаёт защиту внутренних сетей (секция protectedNetworks)
+type ProtectedNetworksConfig struct {
+	Enabled bool     `yaml:"enabled"` // Запрещать соединения с внутренними адресами
+	Extra   []string `yaml:"extra"`   // Дополнительные защищаемые сети
+
+	networks []protectedNetwork
+}
+
+// protectedNetwork - защищаемая сеть и её описание для журнала
+type protectedNetwork struct {
+	ipNet *net.IPNet
+	kind  string
+}
+
+// compile разбирает встроенные и дополнительные защищаемые сети и добавляет адреса
+// интерфейсов сервера: иначе через прокси были бы доступны службы, слушающие на
+// внешнем адресе (например, панель статистики). Адреса интерфейсов перечитываются
+// при каждой перезагрузке конфигурации.
+func (c *ProtectedNetworksConfig) compile() error {
+	c.networks = nil
+	for _, r := range protectedRanges {
+		_, ipNet, err := net.ParseCIDR(r.cidr)
+		if err != nil {
+			return err
+		}
+		c.networks = append(c.networks, protectedNetwork{ipNet, r.kind})
+	}
+	for _, s := range c.Extra {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return fmt.Errorf("extra: %w", err)
+		}
+		c.networks = append(c.networks, protectedNetwork{ipNet, "extra"})
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("адреса интерфейсов: %w", err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		bits := 8 * net.IPv6len
+		ip := ipNet.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		c.networks = append(c.networks, protectedNetwork{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, "local"})
+	}
+	return nil
+}
+
+// protectedBy возвращает защищаемую сеть, в которую попадает ip
+func (c *ProtectedNetworksConfig) protectedBy(ip net.IP) (protectedNetwork, bool) {
+	for _, n := range c.networks {
+		if n.ipNet.Contains(ip) {
+			return n, true
+		}
+	}
+	return protectedNetwork{}, false
+}
+
+// compileAllowPrivate разбирает исключения пользователя из защиты внутренних сетей
+func compileAllowPrivate(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		ipNet, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// userAllowPrivate возвращает разрешённые пользователю внутренние сети
+func userAllowPrivate(username string) []*net.IPNet {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	return users[username].allowPrivate
+}
+
+// filterProtected отбрасывает адреса из защищаемых сетей, кроме разрешённых пользователю
+// в allowPrivate. Проверяются уже разрешённые адреса, поэтому защиту не обойти именем,
+// указывающим на внутренний адрес. Если не осталось ни одного адреса, возвращается отказ.
+func filterProtected(sess *session, host string, port int, ips []net.IP) ([]net.IP, error) {
+	if !config.ProtectedNetworks.Enabled {
+		return ips, nil
+	}
+	exceptions := userAllowPrivate(sess.username)
+
+	var allowed []net.IP
+	var denied protectedNetwork
+	for _, ip := range ips {
+		n, protected := config.ProtectedNetworks.protectedBy(ip)
+		if !protected || networksContain(exceptions, ip) {
+			allowed = append(allowed, ip)
+		} else if denied.ipNet == nil {
+			denied = n
+		}
+	}
+	if len(allowed) == 0 {
+		rule := fmt.Sprintf("защищённая сеть %s (%s)", denied.ipNet, denied.kind)
+		return nil, denyDestination(sess, host, port, aclVerdict{rule: rule})
+	}
+	return allowed, nil
+}
+
+// networksContain сообщает, попадает ли ip в одну из сетей
+func networksContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
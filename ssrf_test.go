@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProtectedBy(t *testing.T) {
+	c := ProtectedNetworksConfig{Enabled: true, Extra: []string{"198.51.100.0/24", "2001:db8::1"}}
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		kind string // Пусто - адрес не защищён
+	}{
+		{"127.0.0.1", "loopback"},
+		{"127.255.255.254", "loopback"},
+		{"10.1.2.3", "RFC 1918"},
+		{"172.16.0.1", "RFC 1918"},
+		{"172.31.255.255", "RFC 1918"},
+		{"172.32.0.1", ""},
+		{"192.168.1.1", "RFC 1918"},
+		{"169.254.169.254", "link-local"},
+		{"100.64.0.1", "CGNAT"},
+		{"100.128.0.1", ""},
+		{"0.0.0.0", "unspecified"},
+		{"224.0.0.251", "multicast"},
+		{"255.255.255.255", "broadcast"},
+		{"8.8.8.8", ""},
+		{"198.51.100.7", "extra"},
+
+		// IPv4-mapped IPv6 проверяется по сетям IPv4
+		{"::ffff:127.0.0.1", "loopback"},
+		{"::ffff:169.254.169.254", "link-local"},
+		{"::ffff:10.0.0.1", "RFC 1918"},
+		{"::ffff:8.8.8.8", ""},
+
+		{"::", "unspecified"},
+		{"::1", "loopback"},
+		{"fe80::1", "link-local"},
+		{"fd00::1", "ULA"},
+		{"64:ff9b::a9fe:a9fe", "NAT64"},
+		{"ff02::1", "multicast"},
+		{"2001:db8::1", "extra"},
+		{"2001:db8::2", ""},
+		{"2606:4700:4700::1111", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			n, protected := c.protectedBy(net.ParseIP(tt.ip))
+			if protected != (tt.kind != "") {
+				t.Fatalf("protected = %v, ожидалось %v", protected, tt.kind != "")
+			}
+			if protected && n.kind != tt.kind {
+				t.Errorf("kind = %q, ожидалось %q", n.kind, tt.kind)
+			}
+		})
+	}
+
+	// Адреса интерфейсов сервера защищены, даже если это внешние адреса
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatalf("InterfaceAddrs: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if _, protected := c.protectedBy(ipNet.IP); !protected {
+				t.Errorf("адрес интерфейса %s не защищён", ipNet.IP)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// statsBackupPath возвращает путь к n-й резервной копии файла статистики
+func statsBackupPath(n int) string {
+	return config.StatsFile + "." + strconv.Itoa(n)
+}
+
+// writeStatsFile атомарно записывает файл статистики. Предыдущий снимок перед этим
+// становится резервной копией statsFile.1, более старые сдвигаются до statsFile.N.
+func writeStatsFile(data []byte) error {
+	if config.StatsBackups > 0 {
+		if err := rotateStatsBackups(); err != nil {
+			log.Printf("Внимание: не удалось обновить резервные копии статистики: %v", err)
+		}
+	}
+	return writeFileAtomic(config.StatsFile, data)
+}
+
+// rotateStatsBackups сдвигает резервные копии и сохраняет текущий файл как statsFile.1.
+// Текущий файл не переименовывается, а связывается жёсткой ссылкой, чтобы панель
+// мониторинга не застала момент, когда его нет.
+func rotateStatsBackups() error {
+	if _, err := os.Stat(config.StatsFile); os.IsNotExist(err) {
+		return nil
+	}
+	for n := config.StatsBackups - 1; n >= 1; n-- {
+		if err := os.Rename(statsBackupPath(n), statsBackupPath(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	first := statsBackupPath(1)
+	if err := os.Remove(first); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(config.StatsFile, first); err != nil {
+		// Файловая система без жёстких ссылок: копируем
+		data, readErr := os.ReadFile(config.StatsFile)
+		if readErr != nil {
+			return readErr
+		}
+		return os.WriteFile(first, data, 0644)
+	}
+	return nil
+}
+
+// readStatsFile читает и разбирает снимок статистики
+func readStatsFile(path string) (GlobalStats, error) {
+	var saved GlobalStats
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return saved, fmt.Errorf("ошибка разбора JSON: %w", err)
+	}
+	return saved, nil
+}
+
+// restoreStats загружает накопленные счётчики из файла статистики, чтобы после
+// перезапуска учёт продолжался, а не начинался с нуля. Если файл повреждён,
+// используется самая свежая читаемая резервная копия.
+func restoreStats() error {
+	source := config.StatsFile
+	saved, err := readStatsFile(source)
+	if os.IsNotExist(err) {
+		if _, backupErr := os.Stat(statsBackupPath(1)); os.IsNotExist(backupErr) {
+			return nil // Первый запуск
+		}
+	}
+	if err != nil {
+		log.Printf("Внимание: файл статистики %s не прочитан: %v", config.StatsFile, err)
+		if !os.IsNotExist(err) {
+			// Повреждённый файл сохраняется для разбора и не попадает в резервные копии
+			corrupt := config.StatsFile + ".corrupt"
+			if renameErr := os.Rename(config.StatsFile, corrupt); renameErr == nil {
+				log.Printf("Повреждённый файл статистики сохранён как %s", corrupt)
+			}
+		}
+		saved, source, err = restoreStatsBackup()
+		if err != nil {
+			return err
+		}
+	}
+	if saved.CountersSince.IsZero() {
+		// Файл записан версией без countersSince: точное начало отсчёта неизвестно
+		saved.CountersSince = saved.LastUpdateTime
+	}
+	mergeStats(saved)
+
+	log.Printf("Статистика восстановлена из %s: отправлено %d, получено %d байт, счётчики ведутся с %s",
+		source, saved.TotalUploadBytes, saved.TotalDownloadBytes, saved.CountersSince.Format(time.RFC3339))
+	return nil
+}
+
+// restoreStatsBackup возвращает самую свежую резервную копию статистики, которую
+// удалось прочитать, и путь к ней
+func restoreStatsBackup() (GlobalStats, string, error) {
+	for n := 1; n <= config.StatsBackups; n++ {
+		path := statsBackupPath(n)
+		saved, err := readStatsFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Внимание: резервная копия статистики %s не прочитана: %v", path, err)
+			}
+			continue
+		}
+		log.Printf("Используется резервная копия статистики %s (снимок от %s)", path, saved.LastUpdateTime.Format(time.RFC3339))
+		return saved, path, nil
+	}
+	return GlobalStats{}, "", fmt.Errorf("нет читаемых резервных копий")
+}
+
+// resetStats обнуляет накопленные счётчики трафика и соединений (сигнал SIGUSR1)
+// и сразу сохраняет файл статистики. Итоги до сброса записываются в журнал.
+func resetStats() {
+	previous := takeStatsDelta()
+
+	// Расход квот относится к расчётному периоду и не сбрасывается
+	trafficMutex.Lock()
+	countersSince = time.Now()
+	trafficMutex.Unlock()
+
+	var upload, download int64
+	for username, stats := range previous.UserStats {
+		upload += stats.UploadBytes
+		download += stats.DownloadBytes
+		log.Printf("Сброс статистики: пользователь %s - отправлено %d, получено %d байт", username, stats.UploadBytes, stats.DownloadBytes)
+	}
+	log.Printf("Статистика сброшена. Итоги с %s: отправлено %d, получено %d байт",
+		previous.CountersSince.Format(time.RFC3339), upload, download)
+
+	saveStats()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Причины таймаутов в журнале и статистике
+const (
+	timeoutHandshake = "handshake" // Приветствие или запрос клиента не получены вовремя
+	timeoutAuth      = "auth"      // Логин и пароль не получены вовремя
+	timeoutConnect   = "connect"   // Целевой хост не ответил вовремя
+	timeoutIdle      = "idle"      // Туннель простаивал без данных в обе стороны
+	timeoutLifetime  = "lifetime"  // Сессия превысила наибольшую длительность
+)
+
+// TimeoutsConfig задаёт таймауты этапов сессии (секция timeouts); 0 - без ограничения
+type TimeoutsConfig struct {
+	Handshake   time.Duration `yaml:"handshake"`   // Приветствие и запрос клиента
+	Auth        time.Duration `yaml:"auth"`        // Логин и пароль SOCKS5
+	Connect     time.Duration `yaml:"connect"`     // Разрешение имени и соединение с целевым хостом
+	Idle        time.Duration `yaml:"idle"`        // Простой туннеля без данных в обе стороны
+	MaxLifetime time.Duration `yaml:"maxLifetime"` // Наибольшая длительность сессии
+}
+
+// validate проверяет, что таймауты не отрицательные
+func (c TimeoutsConfig) validate() error {
+	if c.Handshake < 0 || c.Auth < 0 || c.Connect < 0 || c.Idle < 0 || c.MaxLifetime < 0 {
+		return fmt.Errorf("таймауты не могут быть отрицательными")
+	}
+	return nil
+}
+
+// limit возвращает настроенный таймаут для причины kind
+func (c TimeoutsConfig) limit(kind string) time.Duration {
+	switch kind {
+	case timeoutHandshake:
+		return c.Handshake
+	case timeoutAuth:
+		return c.Auth
+	case timeoutConnect:
+		return c.Connect
+	case timeoutIdle:
+		return c.Idle
+	default:
+		return c.MaxLifetime
+	}
+}
+
+var (
+	timeoutCounts = make(map[string]int64) // Число таймаутов по причинам с момента запуска
+	timeoutsMutex sync.Mutex               // Мьютекс для доступа к timeoutCounts
+)
+
+// sessionTimeoutError - истечение таймаута этапа сессии
+type sessionTimeoutError struct {
+	kind string
+	err  error
+}
+
+func (e *sessionTimeoutError) Error() string {
+	return fmt.Sprintf("таймаут %s (%s): %v", e.kind, config.Timeouts.limit(e.kind), e.err)
+}
+
+func (e *sessionTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// countTimeout учитывает таймаут в статистике
+func countTimeout(kind string) {
+	timeoutsMutex.Lock()
+	timeoutCounts[kind]++
+	timeoutsMutex.Unlock()
+}
+
+// timeoutStats возвращает число таймаутов по причинам
+func timeoutStats() map[string]int64 {
+	timeoutsMutex.Lock()
+	defer timeoutsMutex.Unlock()
+
+	result := make(map[string]int64, len(timeoutCounts))
+	for kind, n := range timeoutCounts {
+		result[kind] = n
+	}
+	return result
+}
+
+// setPhaseDeadline ограничивает время этапа kind на клиентском соединении
+func setPhaseDeadline(conn net.Conn, kind string) {
+	var deadline time.Time
+	if d := config.Timeouts.limit(kind); d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	_ = conn.SetDeadline(deadline)
+}
+
+// phaseTimeout помечает ошибку чтения или записи, вызванную истечением срока этапа kind,
+// и учитывает её. Уже помеченные и прочие ошибки возвращаются без изменений.
+func phaseTimeout(kind string, err error) error {
+	var timeoutErr *sessionTimeoutError
+	if err == nil || errors.As(err, &timeoutErr) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	countTimeout(kind)
+	return &sessionTimeoutError{kind: kind, err: err}
+}
+
+// connectContext возвращает контекст с таймаутом connect для разрешения имени и соединения
+func connectContext() (context.Context, context.CancelFunc) {
+	if config.Timeouts.Connect > 0 {
+		return context.WithTimeout(context.Background(), config.Timeouts.Connect)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// connectTimeout помечает ошибку разрешения имени или соединения, вызванную таймаутом
+func connectTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		countTimeout(timeoutConnect)
+		return &sessionTimeoutError{kind: timeoutConnect, err: err}
+	}
+	return err
+}
+
+// startRelay отмечает начало передачи данных: с этого момента сессия проверяется на простой
+func (s *session) startRelay() {
+	s.lastActivity.Store(time.Now().UnixNano())
+	s.relaying.Store(true)
+}
+
+// checkTimeouts закрывает сессию, превысившую наибольшую длительность или простаивающую
+// дольше timeouts.idle. Вызывается раз в trafficFlushInterval.
+func (s *session) checkTimeouts(now time.Time) {
+	t := config.Timeouts
+	switch {
+	case t.MaxLifetime > 0 && now.Sub(s.started) > t.MaxLifetime:
+		s.expire(timeoutLifetime)
+	case t.Idle > 0 && s.relaying.Load() && now.Sub(time.Unix(0, s.lastActivity.Load())) > t.Idle:
+		s.expire(timeoutIdle)
+	}
+}
+
+// expire закрывает сессию по таймауту kind; повторные вызовы ничего не делают
+func (s *session) expire(kind string) {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if s.closeReason != "" {
+		return
+	}
+	countTimeout(kind)
+	s.closeReason = fmt.Sprintf("таймаут %s (%s)", kind, config.Timeouts.limit(kind))
+	log.Printf("Сессия пользователя %s (с %s) закрыта: %s", s.username, s.conn.RemoteAddr(), s.closeReason)
+	s.closeLocked()
+}
+
+// closedBy возвращает причину принудительного закрытия сессии, если она известна
+func (s *session) closedBy() string {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return s.closeReason
+}
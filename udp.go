@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpBufferSize          = 65535 // Максимальный размер UDP датаграммы
+	udpMaxReassembledBytes = 65535 // Максимальный размер собранной датаграммы
+	udpFragmentEndFlag     = 0x80  // Старший бит FRAG отмечает последний фрагмент
+
+	udpMaxResolved = 1024        // Наибольшее число адресов назначения в кэше ассоциации
+	udpResolveTTL  = time.Minute // Сколько действует разрешённый адрес назначения
+	udpMaxPending  = 8           // Сколько датаграмм ждут разрешения имени назначения
+
+	udpMaxPeers = 1024            // Наибольшее число получателей, от которых ассоциация принимает ответы
+	udpPeerTTL  = 2 * time.Minute // Сколько после последней отправки принимаются ответы получателя
+)
+
+// udpAssociation описывает одну UDP-ассоциацию SOCKS5 (команда UDP ASSOCIATE)
+type udpAssociation struct {
+	relayConn  *net.UDPConn // Сокет для обмена с клиентом (BND.ADDR/BND.PORT)
+	remoteConn *net.UDPConn // Сокет для обмена с целевыми хостами
+
+	clientIP   net.IP                      // Клиенту разрешено слать датаграммы только с этого IP
+	clientAddr atomic.Pointer[net.UDPAddr] // Полный адрес клиента, фиксируется по первой датаграмме
+
+	sess *session
+
+	uploadLimits   []*tokenBucket // Датаграммы сверх ограничения скорости отбрасываются
+	downloadLimits []*tokenBucket
+
+	// Итоги ассоциации для журнала; в статистику байты попадают через счётчики сессии
+	uploadBytes   atomic.Int64
+	downloadBytes atomic.Int64
+
+	resolved     map[string]*udpResolved // Кэш разрешённых адресов назначения
+	resolveMutex sync.Mutex              // Мьютекс для доступа к resolved
+	resolving    sync.WaitGroup          // Фоновые разрешения имён
+	closed       context.Context         // Отменяется при закрытии ассоциации
+
+	reasm udpReassembly // Очередь сборки фрагментов
+
+	// Получатели, которым клиент отправлял датаграммы, и срок приёма их ответов.
+	// Датаграммы с других адресов клиенту не пересылаются.
+	peers      map[string]time.Time
+	peersMutex sync.Mutex
+}
+
+// udpResolved - адрес назначения в кэше ассоциации
+type udpResolved struct {
+	addr    *net.UDPAddr // nil - адрес запрещён правилами доступа
+	expires time.Time
+
+	resolving bool     // Имя ещё разрешается
+	pending   [][]byte // Датаграммы, ожидающие разрешения имени
+}
+
+// udpReassembly хранит состояние сборки фрагментированной датаграммы
+type udpReassembly struct {
+	lastFrag byte
+	target   string
+	data     []byte
+	deadline time.Time
+}
+
+func (r *udpReassembly) reset() {
+	r.lastFrag = 0
+	r.target = ""
+	r.data = r.data[:0]
+	r.deadline = time.Time{}
+}
+
+// handleUDPAssociate обрабатывает команду UDP ASSOCIATE: открывает UDP-ретранслятор
+// и держит его до закрытия управляющего TCP-соединения
+func handleUDPAssociate(conn net.Conn, sess *session, destAddr string, destPort int) error {
+	clientTCPAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSocks5Reply(conn, replyGeneralFailure, nil)
+		return fmt.Errorf("UDP ASSOCIATE поддерживается только для TCP-клиентов")
+	}
+
+	// Ретранслятор слушает на том же локальном адресе, на который пришло TCP-соединение
+	var localIP net.IP
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = writeSocks5Reply(conn, replyGeneralFailure, nil)
+		return fmt.Errorf("не удалось открыть UDP-сокет ретранслятора: %w", err)
+	}
+	defer relayConn.Close()
+
+	remoteConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = writeSocks5Reply(conn, replyGeneralFailure, nil)
+		return fmt.Errorf("не удалось открыть исходящий UDP-сокет: %w", err)
+	}
+	defer remoteConn.Close()
+
+	closed, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assoc := &udpAssociation{
+		relayConn:  relayConn,
+		remoteConn: remoteConn,
+		clientIP:   clientTCPAddr.IP,
+		sess:       sess,
+		resolved:   make(map[string]*udpResolved),
+		closed:     closed,
+		peers:      make(map[string]time.Time),
+	}
+	assoc.uploadLimits, assoc.downloadLimits = sessionLimiters(sess)
+
+	// Если клиент заранее сообщил свой адрес и порт, принимаем датаграммы только с него
+	if ip := net.ParseIP(destAddr); ip != nil && !ip.IsUnspecified() && destPort != 0 {
+		assoc.clientAddr.Store(&net.UDPAddr{IP: ip, Port: destPort})
+	}
+
+	if err := writeSocks5Reply(conn, replySuccess, relayConn.LocalAddr()); err != nil {
+		return fmt.Errorf("ошибка отправки ответа на UDP ASSOCIATE: %w", err)
+	}
+	log.Printf("UDP ассоциация открыта для пользователя %s (%s) на %s", sess.username, conn.RemoteAddr(), relayConn.LocalAddr())
+
+	sess.startRelay()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assoc.relayClientToRemote()
+	}()
+	go func() {
+		defer wg.Done()
+		assoc.relayRemoteToClient()
+	}()
+
+	// Ассоциация завершается вместе с управляющим TCP-соединением
+	_, _ = io.Copy(io.Discard, conn)
+	relayConn.Close()
+	remoteConn.Close()
+	cancel()
+	wg.Wait()
+	assoc.resolving.Wait()
+	assoc.resolved = nil
+	assoc.peers = nil
+
+	upload, download := assoc.uploadBytes.Load(), assoc.downloadBytes.Load()
+	log.Printf("UDP ассоциация закрыта для пользователя %s (%s): отправлено %d, получено %d байт", sess.username, conn.RemoteAddr(), upload, download)
+	return nil
+}
+
+// relayClientToRemote принимает датаграммы клиента, снимает заголовок SOCKS5 и отправляет данные получателю
+func (a *udpAssociation) relayClientToRemote() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.relayConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptFromClient(from) {
+			continue
+		}
+
+		frag, target, payload, ok := parseUDPHeader(buf[:n])
+		if !ok {
+			continue
+		}
+
+		if frag == 0x00 {
+			a.reasm.reset()
+			a.sendToRemote(target, payload)
+			continue
+		}
+
+		if data, ok := a.reassemble(frag, target, payload); ok {
+			a.sendToRemote(target, data)
+		}
+	}
+}
+
+// parseUDPHeader разбирает заголовок UDP-датаграммы SOCKS5: RSV, FRAG и адрес
+// назначения. Возвращает false, если заголовок некорректен.
+func parseUDPHeader(packet []byte) (frag byte, target string, payload []byte, ok bool) {
+	if len(packet) < 4 || packet[0] != 0x00 || packet[1] != 0x00 {
+		return 0, "", nil, false // RSV должен быть нулевым
+	}
+	r := bytes.NewReader(packet[3:])
+	destAddr, destPort, err := readSocks5Address(r)
+	if err != nil || destAddr == "" {
+		return 0, "", nil, false
+	}
+	return packet[2], net.JoinHostPort(destAddr, strconv.Itoa(destPort)), packet[len(packet)-r.Len():], true
+}
+
+// acceptFromClient проверяет, что датаграмма пришла от клиента этой ассоциации
+func (a *udpAssociation) acceptFromClient(from *net.UDPAddr) bool {
+	if !from.IP.Equal(a.clientIP) {
+		return false
+	}
+	if expected := a.clientAddr.Load(); expected != nil {
+		return expected.IP.Equal(from.IP) && expected.Port == from.Port
+	}
+	a.clientAddr.Store(from)
+	return true
+}
+
+// reassemble добавляет фрагмент в очередь сборки. Возвращает собранную датаграмму,
+// когда получен фрагмент с флагом окончания последовательности.
+func (a *udpAssociation) reassemble(frag byte, target string, payload []byte) ([]byte, bool) {
+	pos := frag &^ udpFragmentEndFlag
+	if pos == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	q := &a.reasm
+	if q.lastFrag != 0 && (now.After(q.deadline) || pos <= q.lastFrag || target != q.target) {
+		// Таймер истёк или началась новая последовательность
+		q.reset()
+	}
+	if q.lastFrag == 0 {
+		if pos != 1 {
+			return nil, false // Начало последовательности потеряно
+		}
+		q.target = target
+		q.deadline = now.Add(config.UDP.ReassemblyTimeout)
+	} else if pos != q.lastFrag+1 {
+		q.reset()
+		return nil, false // Фрагмент потерян или пришёл не по порядку
+	}
+
+	if len(q.data)+len(payload) > udpMaxReassembledBytes {
+		q.reset()
+		return nil, false
+	}
+	q.data = append(q.data, payload...)
+	q.lastFrag = pos
+
+	if frag&udpFragmentEndFlag == 0 {
+		return nil, false
+	}
+	data := append([]byte(nil), q.data...)
+	q.reset()
+	return data, true
+}
+
+// sendToRemote отправляет данные целевому хосту и учитывает их как исходящий трафик.
+// Имя хоста разрешается в фоне, чтобы медленный DNS не задерживал датаграммы
+// к другим адресатам; до конца разрешения датаграммы к этому имени ждут в очереди.
+func (a *udpAssociation) sendToRemote(target string, data []byte) {
+	now := time.Now()
+	a.resolveMutex.Lock()
+	cached, ok := a.resolved[target]
+	switch {
+	case ok && cached.resolving:
+		if len(cached.pending) < udpMaxPending {
+			cached.pending = append(cached.pending, append([]byte(nil), data...))
+		}
+		a.resolveMutex.Unlock()
+		return
+	case ok && !now.After(cached.expires):
+		addr := cached.addr
+		a.resolveMutex.Unlock()
+		a.writeToRemote(addr, data)
+		return
+	}
+	a.resolveMutex.Unlock()
+
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return
+	}
+	if net.ParseIP(host) != nil {
+		// Адрес без имени проверяется сразу: разрешать нечего
+		addr, final := a.resolveTarget(context.Background(), target, host, port)
+		if final {
+			a.resolveMutex.Lock()
+			a.cacheResolved(target, &udpResolved{addr: addr, expires: now.Add(udpResolveTTL)}, now)
+			a.resolveMutex.Unlock()
+		}
+		a.writeToRemote(addr, data)
+		return
+	}
+
+	entry := &udpResolved{resolving: true, expires: now.Add(udpResolveTTL), pending: [][]byte{append([]byte(nil), data...)}}
+	a.resolveMutex.Lock()
+	a.cacheResolved(target, entry, now)
+	a.resolveMutex.Unlock()
+	a.resolving.Add(1)
+	go a.resolveInBackground(target, host, port, entry)
+}
+
+// resolveInBackground разрешает имя назначения не дольше timeouts.connect и отправляет
+// датаграммы, ожидавшие разрешения. Закрытие ассоциации прерывает разрешение.
+func (a *udpAssociation) resolveInBackground(target, host string, port int, entry *udpResolved) {
+	defer a.resolving.Done()
+
+	ctx, cancel := connectContext()
+	defer cancel()
+	stop := context.AfterFunc(a.closed, cancel)
+	defer stop()
+	addr, final := a.resolveTarget(ctx, target, host, port)
+
+	a.resolveMutex.Lock()
+	pending := entry.pending
+	entry.addr, entry.pending, entry.resolving = addr, nil, false
+	entry.expires = time.Now().Add(udpResolveTTL)
+	if !final && a.resolved[target] == entry {
+		delete(a.resolved, target) // Ошибку разрешения повторим со следующей датаграммой
+	}
+	a.resolveMutex.Unlock()
+
+	for _, data := range pending {
+		a.writeToRemote(addr, data)
+	}
+}
+
+// resolveTarget проверяет адрес назначения правилами доступа и разрешает имя.
+// Возвращает nil, если адрес запрещён или не разрешается; final сообщает, что
+// результат можно запомнить (ошибку разрешения имени - нельзя).
+func (a *udpAssociation) resolveTarget(ctx context.Context, target, host string, port int) (addr *net.UDPAddr, final bool) {
+	ips, err := resolveDestination(ctx, a.sess, host, port)
+	switch {
+	case errors.Is(err, errDestinationDenied):
+		// Отказ записан в журнал один раз, дальнейшие датаграммы молча отбрасываются
+		return nil, true
+	case err != nil:
+		if a.closed.Err() == nil {
+			log.Printf("UDP: не удалось разрешить адрес %s (пользователь %s): %v", target, a.sess.username, connectTimeout(err))
+		}
+		return nil, false
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, true
+}
+
+// writeToRemote отправляет датаграмму по разрешённому адресу
+func (a *udpAssociation) writeToRemote(addr *net.UDPAddr, data []byte) {
+	if addr == nil {
+		return
+	}
+	if !allowBuckets(a.uploadLimits, len(data)) {
+		return
+	}
+	n, err := a.remoteConn.WriteToUDP(data, addr)
+	if err != nil {
+		return
+	}
+	a.rememberPeer(addr, time.Now())
+	a.uploadBytes.Add(int64(n))
+	a.sess.pendingUpload.Add(int64(n))
+}
+
+// cacheResolved запоминает адрес назначения. Когда кэш заполнен, из него удаляются
+// устаревшие записи, а если таких нет - произвольная запись. Вызывается под resolveMutex.
+func (a *udpAssociation) cacheResolved(target string, r *udpResolved, now time.Time) {
+	if _, ok := a.resolved[target]; !ok && len(a.resolved) >= udpMaxResolved {
+		for t, cached := range a.resolved {
+			if !cached.resolving && now.After(cached.expires) {
+				delete(a.resolved, t)
+			}
+		}
+		for t := range a.resolved {
+			if len(a.resolved) < udpMaxResolved {
+				break
+			}
+			delete(a.resolved, t)
+		}
+	}
+	a.resolved[target] = r
+}
+
+// rememberPeer разрешает приём ответов от получателя addr на udpPeerTTL. Когда список
+// заполнен, из него удаляются устаревшие записи, а если таких нет - произвольная запись.
+func (a *udpAssociation) rememberPeer(addr *net.UDPAddr, now time.Time) {
+	key := addr.String()
+	a.peersMutex.Lock()
+	defer a.peersMutex.Unlock()
+
+	if _, ok := a.peers[key]; !ok && len(a.peers) >= udpMaxPeers {
+		for p, expires := range a.peers {
+			if now.After(expires) {
+				delete(a.peers, p)
+			}
+		}
+		for p := range a.peers {
+			if len(a.peers) < udpMaxPeers {
+				break
+			}
+			delete(a.peers, p)
+		}
+	}
+	a.peers[key] = now.Add(udpPeerTTL)
+}
+
+// knownPeer проверяет, что клиент недавно отправлял датаграммы на адрес addr
+func (a *udpAssociation) knownPeer(addr *net.UDPAddr, now time.Time) bool {
+	a.peersMutex.Lock()
+	defer a.peersMutex.Unlock()
+
+	expires, ok := a.peers[addr.String()]
+	return ok && !now.After(expires)
+}
+
+// relayRemoteToClient принимает ответы целевых хостов и пересылает их клиенту с заголовком SOCKS5.
+// Датаграммы от адресов, которым клиент не отправлял данных, отбрасываются.
+func (a *udpAssociation) relayRemoteToClient() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, from, err := a.remoteConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		clientAddr := a.clientAddr.Load()
+		if clientAddr == nil {
+			continue // Клиент ещё не отправил ни одной датаграммы
+		}
+		if !a.knownPeer(from, time.Now()) {
+			continue
+		}
+
+		if !allowBuckets(a.downloadLimits, n) {
+			continue
+		}
+
+		packet := appendSocks5Address([]byte{0x00, 0x00, 0x00}, from.IP, from.Port)
+		packet = append(packet, buf[:n]...)
+		if _, err := a.relayConn.WriteToUDP(packet, clientAddr); err != nil {
+			continue
+		}
+		a.downloadBytes.Add(int64(n))
+		a.sess.pendingDownload.Add(int64(n))
+	}
+}
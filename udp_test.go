@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUDPHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		packet  []byte
+		frag    byte
+		target  string
+		payload string
+		ok      bool
+	}{
+		{"IPv4", []byte{0, 0, 0, 1, 8, 8, 8, 8, 0, 53, 'q'}, 0, "8.8.8.8:53", "q", true},
+		{"имя", append([]byte{0, 0, 0x81, 3, 11}, "example.com\x01\xbbdata"...), 0x81, "example.com:443", "data", true},
+		{"IPv6", append([]byte{0, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0, 53), 0, "[2001:db8::1]:53", "", true},
+		{"короткий пакет", []byte{0, 0, 0}, 0, "", "", false},
+		{"ненулевой RSV", []byte{0, 1, 0, 1, 8, 8, 8, 8, 0, 53}, 0, "", "", false},
+		{"неизвестный ATYP", []byte{0, 0, 0, 5, 8, 8, 8, 8, 0, 53}, 0, "", "", false},
+		{"обрезанный адрес", []byte{0, 0, 0, 1, 8, 8}, 0, "", "", false},
+		{"нет порта", []byte{0, 0, 0, 1, 8, 8, 8, 8, 0}, 0, "", "", false},
+		{"обрезанное имя", []byte{0, 0, 0, 3, 10, 'a', 'b'}, 0, "", "", false},
+		{"пустое имя", []byte{0, 0, 0, 3, 0, 0, 53}, 0, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frag, target, payload, ok := parseUDPHeader(tt.packet)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, ожидалось %v", ok, tt.ok)
+			}
+			if ok && (frag != tt.frag || target != tt.target || string(payload) != tt.payload) {
+				t.Errorf("= %#x, %q, %q, ожидалось %#x, %q, %q", frag, target, payload, tt.frag, tt.target, tt.payload)
+			}
+		})
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	type step struct {
+		frag    byte
+		target  string
+		payload string
+		expire  bool   // Перед фрагментом истекает таймер сборки
+		want    string // Собранная датаграмма; пусто - ничего не отправляется
+	}
+	const a, b = "198.51.100.1:53", "198.51.100.2:53"
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"по порядку", []step{{1, a, "x", false, ""}, {2, a, "y", false, ""}, {0x83, a, "z", false, "xyz"}}},
+		{"единственный фрагмент", []step{{0x81, a, "x", false, "x"}}},
+		{"нулевая позиция с флагом окончания", []step{{0x80, a, "x", false, ""}}},
+		{"потеряно начало", []step{{2, a, "y", false, ""}, {0x83, a, "z", false, ""}}},
+		{"пропуск фрагмента", []step{{1, a, "x", false, ""}, {0x83, a, "z", false, ""}, {0x82, a, "y", false, ""}}},
+		{"новая последовательность", []step{{1, a, "x", false, ""}, {2, a, "y", false, ""}, {1, a, "p", false, ""}, {0x82, a, "q", false, "pq"}}},
+		{"повтор позиции", []step{{1, a, "x", false, ""}, {1, a, "p", false, ""}, {0x82, a, "q", false, "pq"}}},
+		{"смена получателя", []step{{1, a, "x", false, ""}, {0x82, b, "y", false, ""}, {1, b, "p", false, ""}, {0x82, b, "q", false, "pq"}}},
+		{"истёк таймер", []step{{1, a, "x", false, ""}, {0x82, a, "y", true, ""}, {1, a, "p", false, ""}, {0x82, a, "q", false, "pq"}}},
+		{"после сборки всё сначала", []step{{0x81, a, "x", false, "x"}, {0x82, a, "y", false, ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assoc := &udpAssociation{}
+			for i, s := range tt.steps {
+				if s.expire {
+					assoc.reasm.deadline = time.Now().Add(-time.Second)
+				}
+				data, ok := assoc.reassemble(s.frag, s.target, []byte(s.payload))
+				if ok != (s.want != "") || string(data) != s.want {
+					t.Fatalf("шаг %d (FRAG %#x): %q, %v, ожидалось %q", i+1, s.frag, data, ok, s.want)
+				}
+			}
+		})
+	}
+
+	// Датаграмма больше udpMaxReassembledBytes не собирается
+	assoc := &udpAssociation{}
+	chunk := []byte(strings.Repeat("x", udpMaxReassembledBytes/2+1))
+	if _, ok := assoc.reassemble(1, a, chunk); ok {
+		t.Fatalf("первый фрагмент собран")
+	}
+	if data, ok := assoc.reassemble(0x82, a, chunk); ok || assoc.reasm.lastFrag != 0 {
+		t.Errorf("слишком большая датаграмма: собрано %d байт, очередь не сброшена", len(data))
+	}
+	if data, ok := assoc.reassemble(0x81, a, []byte("ok")); !ok || !bytes.Equal(data, []byte("ok")) {
+		t.Errorf("после сброса: %q, %v", data, ok)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// upgradeEnv передаёт новому процессу список унаследованных слушателей:
+	// "имя=сеть,адрес;..." в порядке дескрипторов, начиная с upgradeFirstListenerFD
+	upgradeEnv = "ELIZA_UPGRADE_LISTENERS"
+
+	upgradeControlFD       = 3 // Управляющий сокет между старым и новым процессом
+	upgradeFirstListenerFD = 4
+
+	upgradeReadyTimeout = 30 * time.Second // Сколько ждать готовности нового процесса
+	upgradeReady        = "ready"
+)
+
+// statsHandedOff выставляется, когда учёт статистики передан новому процессу:
+// после этого старый процесс больше не пишет файл статистики
+var statsHandedOff atomic.Bool
+
+// upgradeKey идентифицирует слушатель при передаче: если в новой конфигурации
+// у точки входа изменился адрес, унаследованный сокет не используется
+func upgradeKey(name, network, address string) string {
+	return name + "=" + network + "," + address
+}
+
+// startUpgrade запускает новый экземпляр исполняемого файла и передаёт ему
+// слушающие сокеты. Возвращает управляющее соединение, когда новый процесс
+// начал принимать соединения; при ошибке текущий процесс продолжает работу.
+func startUpgrade(listeners []*proxyListener) (net.Conn, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось определить путь к исполняемому файлу: %w", err)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось создать управляющий сокет: %w", err)
+	}
+	parentFile := os.NewFile(uintptr(fds[0]), "upgrade-parent")
+	childFile := os.NewFile(uintptr(fds[1]), "upgrade-child")
+	defer childFile.Close()
+	control, err := net.FileConn(parentFile)
+	parentFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось открыть управляющий сокет: %w", err)
+	}
+
+	files := []*os.File{childFile}
+	var keys []string
+	defer func() {
+		for _, f := range files[1:] {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			control.Close()
+			return nil, fmt.Errorf("слушатель %s не поддерживает передачу сокета", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			control.Close()
+			return nil, fmt.Errorf("слушатель %s: %w", l.name, err)
+		}
+		files = append(files, f)
+		keys = append(keys, upgradeKey(l.name, l.network, l.bindAddress))
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(keys, ";"))
+	if err := cmd.Start(); err != nil {
+		control.Close()
+		return nil, fmt.Errorf("не удалось запустить %s: %w", exe, err)
+	}
+	go cmd.Wait() // Новый процесс переживёт текущий; Wait нужен, если он упадёт раньше
+
+	_ = control.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	line, err := bufio.NewReader(control).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != upgradeReady {
+		control.Close()
+		_ = cmd.Process.Kill()
+		return nil, fmt.Errorf("новый процесс (pid %d) не сообщил о готовности: %v", cmd.Process.Pid, err)
+	}
+	_ = control.SetReadDeadline(time.Time{})
+
+	log.Printf("Новый процесс (pid %d) принимает соединения, передаём ему слушатели и статистику", cmd.Process.Pid)
+	return control, nil
+}
+
+// handOffListeners закрывает слушатели без удаления файлов Unix-сокетов,
+// которые теперь обслуживает новый процесс
+func handOffListeners(listeners []*proxyListener) {
+	for _, l := range listeners {
+		if ul, ok := l.listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.listener.Close()
+	}
+}
+
+// sendStatsDelta передаёт новому процессу накопленную статистику и обнуляет
+// её у себя, поэтому каждый байт учитывается ровно один раз. Расход квот
+// передаётся приращением и у себя не обнуляется (см. takeQuotaDelta).
+func sendStatsDelta(control net.Conn) error {
+	statsHandedOff.Store(true)
+	delta := takeStatsDelta()
+	delta.QuotaUsage = takeQuotaDelta()
+	return json.NewEncoder(control).Encode(delta)
+}
+
+// takeStatsDelta забирает счётчики трафика и соединений, обнуляя их. Расход квот
+// не затрагивается. Число активных соединений слушателей не передаётся: его ведёт
+// каждый процесс сам.
+func takeStatsDelta() GlobalStats {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	delta := GlobalStats{
+		UserStats:      trafficStats,
+		CountryStats:   countryStats,
+		ListenerStats:  make(map[string]*ListenerStats),
+		CountersSince:  countersSince,
+		LastUpdateTime: time.Now(),
+	}
+	trafficStats = make(map[string]UserTraffic)
+	countryStats = make(map[string]*CountryStats)
+	for name, stats := range listenerStats {
+		delta.ListenerStats[name] = &ListenerStats{
+			UploadBytes:   stats.UploadBytes,
+			DownloadBytes: stats.DownloadBytes,
+			Connections:   stats.Connections,
+		}
+		stats.UploadBytes, stats.DownloadBytes, stats.Connections = 0, 0, 0
+	}
+	return delta
+}
+
+// mergeStats добавляет статистику, полученную от предыдущего процесса или из файла.
+// Начало отсчёта берётся из delta, если оно там указано.
+func mergeStats(delta GlobalStats) {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+
+	if !delta.CountersSince.IsZero() {
+		countersSince = delta.CountersSince
+	}
+
+	for username, d := range delta.UserStats {
+		stats := trafficStats[username]
+		stats.UploadBytes += d.UploadBytes
+		stats.DownloadBytes += d.DownloadBytes
+		trafficStats[username] = stats
+	}
+	for code, d := range delta.CountryStats {
+		stats, ok := countryStats[code]
+		if !ok {
+			stats = &CountryStats{}
+			countryStats[code] = stats
+		}
+		stats.UploadBytes += d.UploadBytes
+		stats.DownloadBytes += d.DownloadBytes
+		stats.Connections += d.Connections
+	}
+	for name, d := range delta.ListenerStats {
+		stats := listenerStatsFor(name)
+		stats.UploadBytes += d.UploadBytes
+		stats.DownloadBytes += d.DownloadBytes
+		stats.Connections += d.Connections
+	}
+	mergeQuotaUsage(delta.QuotaUsage)
+}
+
+// inheritedListeners возвращает слушатели, переданные предыдущим процессом при
+// обновлении, и управляющее соединение с ним. Вне обновления оба результата nil.
+func inheritedListeners() (map[string]net.Listener, net.Conn, error) {
+	spec, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	controlFile := os.NewFile(upgradeControlFD, "upgrade-control")
+	control, err := net.FileConn(controlFile)
+	controlFile.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("управляющий сокет обновления: %w", err)
+	}
+
+	inherited := make(map[string]net.Listener)
+	if spec == "" {
+		return inherited, control, nil
+	}
+	for i, key := range strings.Split(spec, ";") {
+		f := os.NewFile(uintptr(upgradeFirstListenerFD+i), "listener-"+strconv.Itoa(i))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range inherited {
+				l.Close()
+			}
+			control.Close()
+			return nil, nil, fmt.Errorf("унаследованный слушатель %s: %w", key, err)
+		}
+		inherited[key] = ln
+	}
+	return inherited, control, nil
+}
+
+// finishUpgrade сообщает предыдущему процессу о готовности, дожидается его
+// статистики и в фоне принимает остаток, накопленный его сессиями за время завершения
+func finishUpgrade(control net.Conn) {
+	if _, err := fmt.Fprintln(control, upgradeReady); err != nil {
+		log.Printf("Обновление: не удалось связаться с предыдущим процессом: %v", err)
+		control.Close()
+		return
+	}
+
+	decoder := json.NewDecoder(control)
+	var delta GlobalStats
+	_ = control.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+	if err := decoder.Decode(&delta); err != nil {
+		log.Printf("Обновление: статистика предыдущего процесса не получена: %v", err)
+		control.Close()
+		return
+	}
+	_ = control.SetReadDeadline(time.Time{})
+	mergeStats(delta)
+	log.Println("Обновление: статистика предыдущего процесса получена")
+
+	go func() {
+		defer control.Close()
+		for {
+			var delta GlobalStats
+			if err := decoder.Decode(&delta); err != nil {
+				if !errors.Is(err, io.EOF) {
+					log.Printf("Обновление: ошибка получения статистики предыдущего процесса: %v", err)
+				}
+				return
+			}
+			mergeStats(delta)
+		}
+	}()
+}
+
+// sdNotify отправляет состояние systemd (Type=notify), если сервис запущен под ним
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Не удалось отправить уведомление systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte(state))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// readUsersFile читает и проверяет файл пользователей, не трогая текущую таблицу users
+func readUsersFile(path string) (map[string]User, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия файла пользователей %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var tempUsers map[string]User
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&tempUsers); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования JSON из файла пользователей %s: %w", path, err)
+	}
+	if err := validateUsers(tempUsers); err != nil {
+		return nil, fmt.Errorf("файл пользователей %s: %w", path, err)
+	}
+	return tempUsers, nil
+}
+
+// validateUsers проверяет записи пользователей. Пустое поле username заполняется ключом.
+func validateUsers(m map[string]User) error {
+	if m == nil {
+		return fmt.Errorf("ожидается JSON-объект с пользователями")
+	}
+	for key, user := range m {
+		if key == "" || len(key) > 255 {
+			return fmt.Errorf("некорректное имя пользователя %q", key)
+		}
+		if user.Username == "" {
+			user.Username = key
+			m[key] = user
+		} else if user.Username != key {
+			return fmt.Errorf("пользователь %q: поле username (%q) не совпадает с ключом", key, user.Username)
+		}
+		if user.Password == "" {
+			return fmt.Errorf("пользователь %q: пустой пароль", key)
+		}
+		if err := checkPasswordFormat(user.Password); err != nil {
+			return fmt.Errorf("пользователь %q: %w", key, err)
+		}
+		if err := user.RateLimit.validate(); err != nil {
+			return fmt.Errorf("пользователь %q: rateLimit: %w", key, err)
+		}
+		if err := user.Quota.validate(); err != nil {
+			return fmt.Errorf("пользователь %q: quota: %w", key, err)
+		}
+		if user.MaxConnections < 0 || user.MaxSourceIPs < 0 {
+			return fmt.Errorf("пользователь %q: maxConnections и maxSourceIPs не могут быть отрицательными", key)
+		}
+		if err := validateAccountWindow(user); err != nil {
+			return fmt.Errorf("пользователь %q: %w", key, err)
+		}
+		if err := compileACL(user.ACL); err != nil {
+			return fmt.Errorf("пользователь %q: acl: %w", key, err)
+		}
+		allowPrivate, err := compileAllowPrivate(user.AllowPrivate)
+		if err != nil {
+			return fmt.Errorf("пользователь %q: allowPrivate: %w", key, err)
+		}
+		user.allowPrivate = allowPrivate
+		m[key] = user
+	}
+	return nil
+}
+
+// usersDiff - изменения таблицы пользователей при перезагрузке
+type usersDiff struct {
+	added, removed, disabled, enabled, changed []string
+}
+
+func diffUsers(oldUsers, newUsers map[string]User) usersDiff {
+	var d usersDiff
+	for name, newUser := range newUsers {
+		oldUser, ok := oldUsers[name]
+		switch {
+		case !ok:
+			d.added = append(d.added, name)
+		case oldUser.Enabled && !newUser.Enabled:
+			d.disabled = append(d.disabled, name)
+		case !oldUser.Enabled && newUser.Enabled:
+			d.enabled = append(d.enabled, name)
+		case !reflect.DeepEqual(oldUser, newUser):
+			d.changed = append(d.changed, name)
+		}
+	}
+	for name := range oldUsers {
+		if _, ok := newUsers[name]; !ok {
+			d.removed = append(d.removed, name)
+		}
+	}
+	for _, list := range [][]string{d.added, d.removed, d.disabled, d.enabled, d.changed} {
+		sort.Strings(list)
+	}
+	return d
+}
+
+// reloadUsers перечитывает файл пользователей и заменяет таблицу users.
+// При ошибке текущая таблица остаётся без изменений.
+func reloadUsers() error {
+	newUsers, err := readUsersFile(config.UsersFile)
+	if err != nil {
+		return err
+	}
+
+	usersMutex.Lock()
+	oldUsers := users
+	users = newUsers
+	usersMutex.Unlock()
+
+	warnPlaintextPasswords(newUsers)
+	updateUserRateLimits()
+	d := diffUsers(oldUsers, newUsers)
+	log.Printf("Пользователи перезагружены из %s: всего %d, добавлены %v, удалены %v, отключены %v, включены %v, изменены %v",
+		config.UsersFile, len(newUsers), d.added, d.removed, d.disabled, d.enabled, d.changed)
+
+	if config.Users.TerminateSessions && len(d.removed)+len(d.disabled) > 0 {
+		revoked := make(map[string]bool)
+		for _, name := range append(d.removed, d.disabled...) {
+			revoked[name] = true
+		}
+		if n := closeUserSessions(revoked); n > 0 {
+			log.Printf("Закрыто сессий удалённых и отключённых пользователей: %d", n)
+		}
+	}
+	return nil
+}
+
+// watchUsersFile перезагружает пользователей по сигналу SIGHUP и при изменении файла.
+// Изменения определяются опросом времени модификации и размера раз в interval (0 - только SIGHUP).
+func watchUsersFile(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	lastStat := statUsersFile()
+	for {
+		select {
+		case <-hup:
+			log.Printf("Получен SIGHUP: перезагрузка пользователей из %s", config.UsersFile)
+		case <-tick:
+			stat := statUsersFile()
+			if stat == lastStat {
+				continue
+			}
+			log.Printf("Файл пользователей %s изменён, перезагрузка", config.UsersFile)
+		}
+
+		// Запоминаем состояние файла до чтения, чтобы ошибочная версия не перечитывалась на каждом тике
+		lastStat = statUsersFile()
+		if err := reloadUsers(); err != nil {
+			log.Printf("Ошибка перезагрузки пользователей, оставлена прежняя таблица: %v", err)
+		}
+	}
+}
+
+// fileStat - признаки изменения файла (пользователей, списка блокировок)
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStat {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStat{}
+	}
+	return fileStat{modTime: info.ModTime(), size: info.Size()}
+}
+
+func statUsersFile() fileStat {
+	return statFile(config.UsersFile)
+}
+
+// checkUserAccess проверяет, можно ли пользователю сессии открыть новое соединение
+// после успешной аутентификации
+func checkUserAccess(sess *session) error {
+	if quotaExceeded(sess.username) {
+		return errQuotaExceeded
+	}
+	return admitSession(sess)
+}